@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type blameCommit struct {
+	hash       string
+	author     string
+	authorTime int64
+}
+
+// addBlame annotates every definition with the most recent commit touching
+// its lines. Files outside a git work tree are skipped.
+func addBlame(results map[string]*printOutput) {
+	for _, out := range results {
+		for _, def := range out.definitions {
+			c, err := blameLines(def.file, def.startLine, def.endLine)
+			if err != nil {
+				continue
+			}
+			def.blame = fmt.Sprintf("%s %s %s", c.hash[:8], c.author, time.Unix(c.authorTime, 0).UTC().Format("2006-01-02"))
+		}
+	}
+}
+
+func blameLines(file string, start, end int) (*blameCommit, error) {
+	cmd := exec.Command("git", "blame", "--porcelain", "-L", fmt.Sprintf("%d,%d", start, end), "--", filepath.Base(file))
+	cmd.Dir = filepath.Dir(file)
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git blame %s: %w", file, err)
+	}
+
+	// Porcelain output repeats the commit headers only the first time a
+	// commit appears, so collect them per hash before picking the newest.
+	commits := make(map[string]*blameCommit)
+	var cur *blameCommit
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "\t") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && len(fields[0]) == 40 {
+			if c, ok := commits[fields[0]]; ok {
+				cur = c
+			} else {
+				cur = &blameCommit{hash: fields[0]}
+				commits[fields[0]] = cur
+			}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "author "):
+			cur.author = strings.TrimPrefix(line, "author ")
+		case strings.HasPrefix(line, "author-time "):
+			cur.authorTime, _ = strconv.ParseInt(strings.TrimPrefix(line, "author-time "), 10, 64)
+		}
+	}
+
+	var newest *blameCommit
+	for _, c := range commits {
+		if newest == nil || c.authorTime > newest.authorTime {
+			newest = c
+		}
+	}
+	if newest == nil {
+		return nil, fmt.Errorf("git blame %s: no output", file)
+	}
+	return newest, nil
+}
+
+// changedLines returns the lines of file that differ from the git revision
+// ref, according to `git diff -U0`.
+func changedLines(file, ref string) (map[int]bool, error) {
+	hunkRegex := regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,(\d+))? @@`)
+
+	cmd := exec.Command("git", "diff", "-U0", ref, "--", filepath.Base(file))
+	cmd.Dir = filepath.Dir(file)
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git diff %s %s: %w", ref, file, err)
+	}
+	changed := make(map[int]bool)
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		m := hunkRegex.FindStringSubmatch(sc.Text())
+		if m == nil {
+			continue
+		}
+		start, _ := strconv.Atoi(m[1])
+		count := 1
+		if m[2] != "" {
+			count, _ = strconv.Atoi(m[2])
+		}
+		for l := start; l < start+count; l++ {
+			changed[l] = true
+		}
+	}
+	return changed, nil
+}
+
+// highlightChanged prefixes the lines of src, which starts at line start of
+// its file, that changed since ref with `// + `.
+func (idx *packageIndex) highlightChanged(src, file string, start int) string {
+	idx.mu.Lock()
+	changed, ok := idx.changed[file]
+	if !ok {
+		var err error
+		if changed, err = changedLines(file, idx.opts.highlightDiff); err != nil {
+			log.Printf("-highlight-diff: %v\n", err)
+		}
+		idx.changed[file] = changed
+	}
+	idx.mu.Unlock()
+	if len(changed) == 0 {
+		return src
+	}
+
+	lines := strings.Split(src, "\n")
+	for i := range lines {
+		if changed[start+i] {
+			lines[i] = "// + " + lines[i]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
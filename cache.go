@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/tools/go/packages"
+)
+
+type cacheEntry struct {
+	Root    string       `json:"root"`
+	PkgPath string       `json:"pkgPath"`
+	PkgName string       `json:"pkgName"`
+	Files   []cachedFile `json:"files"`
+	Deps    []cachedFile `json:"deps"`
+}
+
+type cachedFile struct {
+	Path    string `json:"path"`
+	ModTime int64  `json:"modTime"`
+}
+
+func cachePath(cacheDir, absRoot, pkgPath string) string {
+	sum := sha256.Sum256([]byte(absRoot + "\x00" + pkgPath))
+	return filepath.Join(cacheDir, hex.EncodeToString(sum[:])+".json")
+}
+
+func loadCachedPackage(cacheDir, absRoot, pkgPath string) (*packages.Package, bool) {
+	b, err := os.ReadFile(cachePath(cacheDir, absRoot, pkgPath))
+	if err != nil {
+		return nil, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return nil, false
+	}
+	if entry.Root != absRoot || entry.PkgPath != pkgPath || len(entry.Files) == 0 {
+		return nil, false
+	}
+	for _, f := range append(entry.Files, entry.Deps...) {
+		if modTime(f.Path) != f.ModTime {
+			return nil, false
+		}
+	}
+
+	fset := token.NewFileSet()
+	pkg := &packages.Package{
+		ID:      pkgPath,
+		Name:    entry.PkgName,
+		PkgPath: pkgPath,
+		Fset:    fset,
+	}
+	for _, f := range entry.Files {
+		fAST, err := parser.ParseFile(fset, f.Path, nil, parser.ParseComments)
+		if err != nil {
+			return nil, false
+		}
+		pkg.Syntax = append(pkg.Syntax, fAST)
+		pkg.CompiledGoFiles = append(pkg.CompiledGoFiles, f.Path)
+	}
+	return pkg, true
+}
+
+func storeCachedPackage(cacheDir, absRoot string, pkg *packages.Package) error {
+	entry := cacheEntry{
+		Root:    absRoot,
+		PkgPath: pkg.PkgPath,
+		PkgName: pkg.Name,
+	}
+
+	// The package directories and go.mod are tracked too, so that adding a
+	// file or changing dependencies invalidates the entry.
+	dirs := make(map[string]bool)
+	for _, fAST := range pkg.Syntax {
+		filename := pkg.Fset.Position(fAST.Package).Filename
+		entry.Files = append(entry.Files, cachedFile{Path: filename, ModTime: modTime(filename)})
+		dirs[filepath.Dir(filename)] = true
+	}
+	for dir := range dirs {
+		entry.Deps = append(entry.Deps, cachedFile{Path: dir, ModTime: modTime(dir)})
+	}
+	goMod := filepath.Join(absRoot, "go.mod")
+	entry.Deps = append(entry.Deps, cachedFile{Path: goMod, ModTime: modTime(goMod)})
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return err
+	}
+	path := cachePath(cacheDir, absRoot, pkg.PkgPath)
+	tmp, err := os.CreateTemp(cacheDir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func modTime(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return -1
+	}
+	return fi.ModTime().UnixNano()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"go/token"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// isCgoPackage reports whether pkg was compiled from files cgo generated;
+// go/packages parses those from the build cache, where their names do not
+// end in .go.
+func isCgoPackage(pkg *packages.Package) bool {
+	for _, f := range pkg.CompiledGoFiles {
+		if !strings.HasSuffix(f, ".go") {
+			return true
+		}
+	}
+	return false
+}
+
+// cgoRange maps startPos and endPos, which lie in a file cgo generated, back
+// to byte offsets in the .go file it was generated from, using the //line
+// comments cgo leaves in its output.
+func (idx *packageIndex) cgoRange(startPos, endPos token.Pos) (file string, start, end int, ok bool) {
+	s, e := idx.fset.Position(startPos), idx.fset.Position(endPos)
+	if s.Filename != e.Filename || !strings.HasSuffix(s.Filename, ".go") {
+		return "", 0, 0, false
+	}
+	if s.Filename == idx.fset.PositionFor(startPos, false).Filename {
+		return "", 0, 0, false
+	}
+	content, err := idx.getFileContent(s.Filename)
+	if err != nil {
+		return "", 0, 0, false
+	}
+	start, ok1 := lineColumnOffset(content, s.Line, s.Column)
+	end, ok2 := lineColumnOffset(content, e.Line, e.Column)
+	if !ok1 || !ok2 || start > end {
+		return "", 0, 0, false
+	}
+	return s.Filename, start, end, true
+}
+
+func lineColumnOffset(content []byte, line, column int) (int, bool) {
+	offset := 0
+	for l := 1; l < line; l++ {
+		i := bytes.IndexByte(content[offset:], '\n')
+		if i < 0 {
+			return 0, false
+		}
+		offset += i + 1
+	}
+	offset += column - 1
+	if column < 1 || offset > len(content) {
+		return 0, false
+	}
+	return offset, true
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"go/build"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestCgoPackage(t *testing.T) {
+	if !build.Default.CgoEnabled {
+		t.Skip("cgo is disabled")
+	}
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("no C compiler")
+	}
+	root := fixtureRoot(t)
+	original := filepath.Join(root, "cg", "cg.go")
+	tests := []struct{ sym, want string }{
+		{"example.com/fx/cg.Twice", "func Twice(x int) int {\n\treturn int(C.twice(C.int(x)))\n}"},
+		{"example.com/fx/cg.Box", "type Box struct {\n\tN C.int\n}"},
+	}
+	for _, tt := range tests {
+		def := definitionOf(t, resolve(t, root, testOptions(), tt.sym), tt.sym)
+		if def == nil {
+			continue
+		}
+		if def.source != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.sym, def.source, tt.want)
+		}
+		if def.file != original || def.srcFile != original {
+			t.Errorf("%s: file %s, source file %s; want %s for both", tt.sym, def.file, def.srcFile, original)
+		}
+	}
+}
+
+func TestLineColumnOffset(t *testing.T) {
+	content := []byte("ab\ncde\n\nf")
+	tests := []struct {
+		line, column int
+		want         int
+		ok           bool
+	}{
+		{1, 1, 0, true},
+		{2, 2, 4, true},
+		{3, 1, 7, true},
+		{4, 2, 9, true},
+		{5, 1, 0, false},
+		{2, 0, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := lineColumnOffset(content, tt.line, tt.column)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("lineColumnOffset(%d, %d) = %d, %v; want %d, %v", tt.line, tt.column, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+func readSymbolsFromFile(name string, parser SymbolParser) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := maybeGunzip(f)
+	if err != nil {
+		return nil, err
+	}
+	return readSymbols(r, parser, nil)
+}
+
+// compareSymbols prints, per package, the symbols only in current (+), only
+// in baseline (-) and in both, diff style, and returns the added and removed
+// ones. Symbols are compared in their canonical form, so kind hints,
+// trailing positions and type arguments do not count as differences.
+func compareSymbols(w io.Writer, current, baseline []string) (added, removed []string) {
+	cur, base := symbolSet(current), symbolSet(baseline)
+
+	byPkg := make(map[string][]string)
+	for sym := range cur {
+		byPkg[symbolPackage(sym)] = append(byPkg[symbolPackage(sym)], sym)
+	}
+	for sym := range base {
+		if !cur[sym] {
+			byPkg[symbolPackage(sym)] = append(byPkg[symbolPackage(sym)], sym)
+		}
+	}
+	pkgPaths := make([]string, 0, len(byPkg))
+	for pkgPath := range byPkg {
+		pkgPaths = append(pkgPaths, pkgPath)
+	}
+	sort.Strings(pkgPaths)
+
+	common := 0
+	for _, pkgPath := range pkgPaths {
+		syms := byPkg[pkgPath]
+		sort.Strings(syms)
+		fmt.Fprintf(w, "Package: %s\n", pkgPath)
+		for _, sym := range syms {
+			switch {
+			case cur[sym] && base[sym]:
+				common++
+				fmt.Fprintf(w, "  %s\n", sym)
+			case cur[sym]:
+				added = append(added, sym)
+				fmt.Fprintf(w, "+ %s\n", sym)
+			default:
+				removed = append(removed, sym)
+				fmt.Fprintf(w, "- %s\n", sym)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "%d added, %d removed, %d common\n", len(added), len(removed), common)
+	return added, removed
+}
+
+func symbolSet(symbols []string) map[string]bool {
+	set := make(map[string]bool, len(symbols))
+	for _, sym := range symbols {
+		set[canonicalSymbol(sym)] = true
+	}
+	return set
+}
+
+func symbolPackage(sym string) string {
+	if rs, err := parseRangeSymbol(sym); err == nil && rs != nil {
+		return rs.pkgPath
+	}
+	if pkgPath, _, _, _, err := parseSymbol(sym); err == nil {
+		return pkgPath
+	}
+	return "(unparsed)"
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// embeddedFiles returns the files, relative to the package directory dir,
+// that the //go:embed lines among comments match. Directories are walked
+// recursively, skipping names starting with . or _ unless the pattern has
+// the all: prefix, as the go command does.
+func embeddedFiles(comments []string, dir string) []string {
+	seen := make(map[string]bool)
+	var files []string
+	add := func(path string) {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || seen[rel] {
+			return
+		}
+		seen[rel] = true
+		files = append(files, filepath.ToSlash(rel))
+	}
+	for _, line := range comments {
+		if !strings.HasPrefix(line, "//go:embed ") {
+			continue
+		}
+		for _, pattern := range embedPatterns(strings.TrimPrefix(line, "//go:embed ")) {
+			all := strings.HasPrefix(pattern, "all:")
+			pattern = strings.TrimPrefix(pattern, "all:")
+			matches, _ := filepath.Glob(filepath.Join(dir, filepath.FromSlash(pattern)))
+			for _, m := range matches {
+				filepath.WalkDir(m, func(path string, d fs.DirEntry, err error) error {
+					if err != nil {
+						return nil
+					}
+					if path != m && !all && (strings.HasPrefix(d.Name(), ".") || strings.HasPrefix(d.Name(), "_")) {
+						if d.IsDir() {
+							return filepath.SkipDir
+						}
+						return nil
+					}
+					if !d.IsDir() {
+						add(path)
+					}
+					return nil
+				})
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// embedPatterns splits the arguments of a //go:embed line, which may be
+// double- or back-quoted.
+func embedPatterns(args string) []string {
+	var patterns []string
+	for args = strings.TrimSpace(args); args != ""; args = strings.TrimSpace(args) {
+		if args[0] == '"' || args[0] == '`' {
+			if end := strings.IndexByte(args[1:], args[0]); end >= 0 {
+				if p, err := strconv.Unquote(args[:end+2]); err == nil {
+					patterns = append(patterns, p)
+				}
+				args = args[end+2:]
+				continue
+			}
+		}
+		field := strings.Fields(args)[0]
+		patterns = append(patterns, field)
+		args = args[len(field):]
+	}
+	return patterns
+}
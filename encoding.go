@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// cp1252High maps the bytes 0x80-0x9F of windows-1252, where it differs
+// from latin1; unassigned bytes map to the C1 control of the same value.
+var cp1252High = [32]rune{
+	0x20AC, 0x0081, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008D, 0x017D, 0x008F,
+	0x0090, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0x009D, 0x017E, 0x0178,
+}
+
+// checkEncoding validates -encoding. Only single-byte encodings are
+// supported: every byte is one character, so text sliced at go/token byte
+// offsets decodes the same as the whole file would.
+func checkEncoding(name string) error {
+	switch strings.ToLower(name) {
+	case "utf-8", "utf8", "latin1", "iso-8859-1", "windows-1252", "cp1252":
+		return nil
+	}
+	return fmt.Errorf("unsupported encoding %q: only utf-8 and the single-byte latin1 (iso-8859-1) and windows-1252 can be decoded consistently with byte offsets", name)
+}
+
+func singleByteEncoding(name string) bool {
+	switch strings.ToLower(name) {
+	case "latin1", "iso-8859-1", "windows-1252", "cp1252":
+		return true
+	}
+	return false
+}
+
+// maskNonASCII replaces every non-ASCII byte of src with '?', keeping
+// offsets, so that source in a single-byte encoding parses.
+func maskNonASCII(src []byte) []byte {
+	masked := make([]byte, len(src))
+	for i, c := range src {
+		if c >= 0x80 {
+			c = '?'
+		}
+		masked[i] = c
+	}
+	return masked
+}
+
+// decodeSource converts b, in the -encoding name, to UTF-8.
+func decodeSource(b []byte, name string) string {
+	var high *[32]rune
+	switch strings.ToLower(name) {
+	case "latin1", "iso-8859-1":
+	case "windows-1252", "cp1252":
+		high = &cp1252High
+	default:
+		return string(b)
+	}
+	var sb strings.Builder
+	sb.Grow(len(b))
+	for _, c := range b {
+		if high != nil && c >= 0x80 && c < 0xA0 {
+			sb.WriteRune(high[c-0x80])
+			continue
+		}
+		sb.WriteRune(rune(c))
+	}
+	return sb.String()
+}
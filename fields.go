@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// resolveField finds the field name of the struct type typeName. Fields
+// declared by the type itself are found in the syntax; with
+// -resolve-embedded-fields, promoted fields are looked up with go/types and
+// printed from the struct that declares them.
+func (idx *packageIndex) resolveField(typeName, name string) (*definition, bool, error) {
+	if genDecl, ok := idx.typeSpecs[typeName]; ok {
+		for _, sp := range genDecl.Specs {
+			ts, ok := sp.(*ast.TypeSpec)
+			if !ok || ts.Name.Name != typeName {
+				continue
+			}
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok {
+				break
+			}
+			for _, f := range st.Fields.List {
+				for _, n := range f.Names {
+					if n.Name != name {
+						continue
+					}
+					def, err := idx.newDefinition(f, f.Pos(), f.End())
+					if err != nil {
+						return nil, false, err
+					}
+					def.kind = "field"
+					def.name = typeName + "." + name
+					def.source = "// field of " + typeName + "\n" + def.source
+					return def, true, nil
+				}
+			}
+		}
+	}
+	if !idx.opts.resolveEmbeddedFields {
+		return nil, false, nil
+	}
+	return idx.resolvePromotedField(typeName, name)
+}
+
+func (idx *packageIndex) resolvePromotedField(typeName, name string) (*definition, bool, error) {
+	if idx.pkg.Types == nil {
+		return nil, false, errors.New("no type information for promoted fields")
+	}
+	tn, ok := idx.pkg.Types.Scope().Lookup(typeName).(*types.TypeName)
+	if !ok {
+		return nil, false, nil
+	}
+	obj, index, _ := types.LookupFieldOrMethod(tn.Type(), true, idx.pkg.Types, name)
+	if obj == nil {
+		if index != nil {
+			return nil, false, fmt.Errorf("ambiguous selector %s.%s: promoted from several embedded fields at the same depth", typeName, name)
+		}
+		return nil, false, nil
+	}
+	field, ok := obj.(*types.Var)
+	if !ok || !field.IsField() {
+		return nil, false, nil
+	}
+
+	// Follow the embedded fields named by index to spell the promotion path.
+	path := []string{typeName}
+	t := tn.Type()
+	for _, i := range index[:len(index)-1] {
+		if p, ok := t.Underlying().(*types.Pointer); ok {
+			t = p.Elem()
+		}
+		st, ok := t.Underlying().(*types.Struct)
+		if !ok {
+			break
+		}
+		path = append(path, st.Field(i).Name())
+		t = st.Field(i).Type()
+	}
+	path = append(path, name)
+
+	src, err := idx.fieldSource(field.Pos())
+	if err != nil {
+		return nil, false, err
+	}
+	pos := idx.position(field.Pos())
+	srcFile, offset, _ := idx.sourceRange(field.Pos(), field.Pos())
+	return &definition{
+		kind:      "field",
+		name:      typeName + "." + name,
+		pkgName:   idx.pkg.Name,
+		pkgPath:   idx.pkg.PkgPath,
+		file:      pos.Filename,
+		srcFile:   srcFile,
+		startLine: pos.Line,
+		startCol:  pos.Column,
+		endLine:   pos.Line,
+		endCol:    pos.Column,
+		offset:    offset,
+		endOffset: offset,
+		source:    fmt.Sprintf("// promoted field %s\n%s", strings.Join(path, "."), src),
+	}, true, nil
+}
+
+// fieldSource returns the field declaration at pos, or just its line when
+// the field belongs to a package whose syntax was not loaded.
+func (idx *packageIndex) fieldSource(pos token.Pos) (string, error) {
+	if fAST, ok := idx.files[idx.fset.PositionFor(pos, false).Filename]; ok {
+		var field *ast.Field
+		ast.Inspect(fAST, func(n ast.Node) bool {
+			if f, ok := n.(*ast.Field); ok && f.Pos() <= pos && pos < f.End() {
+				field = f
+			}
+			return true
+		})
+		if field != nil {
+			return idx.extractNodeSource(field, field.Pos(), field.End())
+		}
+	}
+	p := idx.position(pos)
+	content, err := idx.getFileContent(p.Filename)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(decodeSource(content, idx.opts.encoding), "\n")
+	if p.Line < 1 || p.Line > len(lines) {
+		return "", fmt.Errorf("invalid position %s", p)
+	}
+	return strings.TrimSpace(lines[p.Line-1]), nil
+}
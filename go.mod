@@ -2,9 +2,11 @@ module github.com/kis9a/symbolprint
 
 go 1.23.2
 
-require golang.org/x/tools v0.30.0
-
 require (
-	golang.org/x/mod v0.23.0 // indirect
-	golang.org/x/sync v0.11.0 // indirect
+	github.com/fsnotify/fsnotify v1.9.0
+	golang.org/x/mod v0.23.0
+	golang.org/x/sys v0.30.0
+	golang.org/x/tools v0.30.0
 )
+
+require golang.org/x/sync v0.11.0 // indirect
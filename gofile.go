@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// goFileSource assembles the definitions of sec into a single Go file of
+// package sec.pkgName, importing the packages the definitions refer to. A
+// name declared twice, such as a function and a type printed by
+// -all-matches, is kept only the first time. Packages imported under the
+// same name by different files are given distinct names, and the
+// definitions referring to the later ones are rewritten to use them. The
+// result is gofmt'ed when it parses.
+func goFileSource(sec *section) []byte {
+	byName := make(map[string]string) // import path by the name it is imported as
+	byPath := make(map[string]string) // the reverse
+	declared := make(map[string]bool)
+	var body bytes.Buffer
+	for _, def := range sec.definitions {
+		if def.name != "" && def.name != "init" && def.name != "_" {
+			if declared[def.name] {
+				log.Printf("%s: %s is declared more than once; keeping the first declaration\n", sec.title, def.name)
+				continue
+			}
+			declared[def.name] = true
+		}
+		var names []string
+		for name := range def.imports {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		renames := make(map[string]string)
+		for _, name := range names {
+			importPath := def.imports[name]
+			as, ok := byPath[importPath]
+			if !ok {
+				as = name
+				for n := 2; byName[as] != "" || declared[as]; n++ {
+					as = fmt.Sprintf("%s%d", name, n)
+				}
+				byName[as] = importPath
+				byPath[importPath] = as
+			}
+			if as != name {
+				renames[name] = as
+			}
+		}
+		source := def.source
+		if len(renames) > 0 {
+			source = renamePackageRefs(sec.title, source, renames)
+		}
+		body.WriteString(source)
+		body.WriteString("\n\n")
+	}
+
+	var imports []string
+	for as, importPath := range byName {
+		spec := strconv.Quote(importPath)
+		if as != importName(importPath) {
+			spec = as + " " + spec
+		}
+		imports = append(imports, spec)
+	}
+	sort.Strings(imports)
+
+	var src bytes.Buffer
+	fmt.Fprintf(&src, "package %s\n\n", sec.pkgName)
+	if len(imports) > 0 {
+		fmt.Fprintf(&src, "import (\n\t%s\n)\n\n", strings.Join(imports, "\n\t"))
+	}
+	src.Write(body.Bytes())
+	formatted, err := format.Source(src.Bytes())
+	if err != nil {
+		log.Printf("%s: generated file does not parse, printing it unformatted: %v\n", sec.title, err)
+		return src.Bytes()
+	}
+	return formatted
+}
+
+// renamePackageRefs rewrites the package names in the qualified identifiers
+// of source according to renames. Names the parser resolves to a local
+// declaration are left alone.
+func renamePackageRefs(title, source string, renames map[string]string) string {
+	const prefix = "package p\n\n"
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", prefix+source, 0)
+	if err != nil {
+		log.Printf("%s: cannot rename imports in a definition that does not parse: %v\n", title, err)
+		return source
+	}
+	var refs []*ast.Ident
+	ast.Inspect(f, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok && id.Obj == nil && renames[id.Name] != "" {
+				refs = append(refs, id)
+			}
+		}
+		return true
+	})
+	var out strings.Builder
+	last := 0
+	for _, id := range refs {
+		at := fset.Position(id.Pos()).Offset - len(prefix)
+		out.WriteString(source[last:at])
+		out.WriteString(renames[id.Name])
+		last = at + len(id.Name)
+	}
+	out.WriteString(source[last:])
+	return out.String()
+}
+
+// packageRefs returns the packages node refers to through qualified
+// identifiers, by import path keyed by the name used. With type information
+// the names are resolved by go/types; otherwise they are looked up in the
+// imports of node's file.
+func (idx *packageIndex) packageRefs(node ast.Node) map[string]string {
+	var fileImports map[string]string
+	if idx.pkg.TypesInfo == nil {
+		fileImports = make(map[string]string)
+		if fAST := idx.files[idx.fset.PositionFor(node.Pos(), false).Filename]; fAST != nil {
+			for _, spec := range fAST.Imports {
+				importPath, err := strconv.Unquote(spec.Path.Value)
+				if err != nil {
+					continue
+				}
+				name := importName(importPath)
+				if spec.Name != nil {
+					name = spec.Name.Name
+				}
+				fileImports[name] = importPath
+			}
+		}
+	}
+	refs := make(map[string]string)
+	ast.Inspect(node, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		id, ok := sel.X.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		if idx.pkg.TypesInfo == nil {
+			if importPath, ok := fileImports[id.Name]; ok && id.Name != "_" && id.Name != "." {
+				refs[id.Name] = importPath
+			}
+		} else if pkgName, ok := idx.pkg.TypesInfo.Uses[id].(*types.PkgName); ok {
+			refs[id.Name] = pkgName.Imported().Path()
+		}
+		return true
+	})
+	return refs
+}
+
+// importName guesses the name of the package at importPath from its last
+// element, skipping a major version suffix and a gopkg.in-style ".vN".
+func importName(importPath string) string {
+	versionRegex := regexp.MustCompile(`^v[0-9]+$`)
+	suffixRegex := regexp.MustCompile(`\.v[0-9]+$`)
+
+	name := path.Base(importPath)
+	if versionRegex.MatchString(name) && path.Dir(importPath) != "." {
+		name = path.Base(path.Dir(importPath))
+	}
+	name = suffixRegex.ReplaceAllString(name, "")
+	return strings.TrimPrefix(name, "go-")
+}
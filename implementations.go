@@ -0,0 +1,124 @@
+package main
+
+import (
+	"go/types"
+	"log"
+	"sort"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func addImplementations(absRoot string, symbolsByPkg map[string][]string, results map[string]*printOutput, opts *options) {
+	patterns := []string{"./..."}
+	for pkgPath := range symbolsByPkg {
+		patterns = append(patterns, pkgPath)
+	}
+	mode := packages.NeedName | packages.NeedTypes | packages.NeedImports | packages.NeedSyntax | packages.NeedCompiledGoFiles | packages.NeedModule
+	if opts.crossModule {
+		mode |= packages.NeedDeps
+	}
+	cfg := &packages.Config{Dir: absRoot, Env: loadEnv(absRoot), Mode: mode}
+	roots, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		log.Printf("failed to load packages for -implementations: %v\n", err)
+		return
+	}
+
+	byPath := make(map[string]*packages.Package)
+	var candidates []*packages.Package
+	packages.Visit(roots, nil, func(p *packages.Package) {
+		if _, ok := byPath[p.PkgPath]; ok {
+			return
+		}
+		byPath[p.PkgPath] = p
+		if p.Types == nil || len(p.Syntax) == 0 {
+			return
+		}
+		if opts.crossModule || (p.Module != nil && p.Module.Main) {
+			candidates = append(candidates, p)
+		}
+	})
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].PkgPath < candidates[j].PkgPath
+	})
+
+	indexes := make(map[string]*packageIndex)
+	for pkgPath, syms := range symbolsByPkg {
+		pkg, ok := byPath[pkgPath]
+		if !ok || pkg.Types == nil {
+			continue
+		}
+		for _, sym := range syms {
+			_, receiverType, _, name, err := parseSymbol(sym)
+			if err != nil || receiverType != "" {
+				continue
+			}
+			obj, ok := pkg.Types.Scope().Lookup(name).(*types.TypeName)
+			if !ok {
+				continue
+			}
+			iface, ok := obj.Type().Underlying().(*types.Interface)
+			if !ok {
+				continue
+			}
+			for _, cand := range candidates {
+				for _, typeName := range implementersIn(cand, obj, iface) {
+					idx, ok := indexes[cand.PkgPath]
+					if !ok {
+						idx = buildPackageIndex(cand, opts)
+						indexes[cand.PkgPath] = idx
+					}
+					addImplementer(results, idx, sym, typeName, opts)
+				}
+			}
+		}
+	}
+}
+
+func implementersIn(pkg *packages.Package, ifaceObj *types.TypeName, iface *types.Interface) []string {
+	var names []string
+	scope := pkg.Types.Scope()
+	for _, name := range scope.Names() {
+		tn, ok := scope.Lookup(name).(*types.TypeName)
+		if !ok || tn == ifaceObj || tn.IsAlias() {
+			continue
+		}
+		named, ok := tn.Type().(*types.Named)
+		if !ok || named.TypeParams().Len() > 0 {
+			continue
+		}
+		if types.IsInterface(named) {
+			continue
+		}
+		if types.Implements(named, iface) || types.Implements(types.NewPointer(named), iface) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func addImplementer(results map[string]*printOutput, idx *packageIndex, sym, typeName string, opts *options) {
+	genDecl, ok := idx.typeSpecs[typeName]
+	if !ok {
+		return
+	}
+	pkgPath := idx.pkg.PkgPath
+	out, ok := results[pkgPath]
+	if !ok {
+		out = &printOutput{
+			pkgName:     idx.pkg.Name,
+			pkgPath:     pkgPath,
+			definitions: []*definition{},
+		}
+		results[pkgPath] = out
+	}
+	def, err := idx.newDefinition(genDecl, genDecl.Pos(), genDecl.End())
+	if err != nil {
+		log.Printf("failed to extract implementation %s of %q: %v\n", typeName, sym, err)
+		return
+	}
+	out.addDefinition(pkgPath+"."+typeName, def)
+	if opts.methods {
+		idx.addMethods(out, pkgPath+"."+typeName, typeName)
+	}
+}
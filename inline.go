@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"strconv"
+	"strings"
+)
+
+const maxInlineTypeLen = 100
+
+// inlineTypes returns a `// type X = ...` line for each named type used in
+// the signature of fn, in order of appearance, giving its underlying type
+// as computed by go/types. Types of other packages are found through the
+// imports of fn's file.
+func (idx *packageIndex) inlineTypes(fn *ast.FuncDecl) []string {
+	if idx.pkg.Types == nil {
+		return nil
+	}
+	fAST := idx.files[idx.fset.PositionFor(fn.Pos(), false).Filename]
+	imports := make(map[string]*types.Package)
+	for _, imp := range idx.pkg.Types.Imports() {
+		imports[imp.Path()] = imp
+	}
+	importNames := make(map[string]*types.Package)
+	if fAST != nil {
+		for _, spec := range fAST.Imports {
+			path, err := strconv.Unquote(spec.Path.Value)
+			if err != nil || imports[path] == nil {
+				continue
+			}
+			name := imports[path].Name()
+			if spec.Name != nil {
+				name = spec.Name.Name
+			}
+			importNames[name] = imports[path]
+		}
+	}
+
+	seen := make(map[*types.TypeName]bool)
+	var lines []string
+	add := func(obj types.Object, label string) {
+		tn, ok := obj.(*types.TypeName)
+		if !ok || seen[tn] {
+			return
+		}
+		seen[tn] = true
+		u := types.TypeString(tn.Type().Underlying(), types.RelativeTo(idx.pkg.Types))
+		if len(u) > maxInlineTypeLen {
+			u = u[:maxInlineTypeLen] + "..."
+		}
+		lines = append(lines, fmt.Sprintf("// type %s = %s", label, u))
+	}
+
+	var nodes []ast.Node
+	if fn.Recv != nil {
+		nodes = append(nodes, fn.Recv)
+	}
+	nodes = append(nodes, fn.Type)
+	for _, n := range nodes {
+		ast.Inspect(n, func(n ast.Node) bool {
+			switch x := n.(type) {
+			case *ast.SelectorExpr:
+				if pkgIdent, ok := x.X.(*ast.Ident); ok {
+					if imp := importNames[pkgIdent.Name]; imp != nil {
+						add(imp.Scope().Lookup(x.Sel.Name), pkgIdent.Name+"."+x.Sel.Name)
+					}
+				}
+				return false
+			case *ast.Ident:
+				add(idx.pkg.Types.Scope().Lookup(x.Name), x.Name)
+			}
+			return true
+		})
+	}
+	return lines
+}
+
+func prependLines(lines []string, src string) string {
+	return strings.Join(lines, "\n") + "\n" + src
+}
@@ -2,17 +2,30 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"go/ast"
+	"go/build"
 	"go/token"
+	"go/types"
+	"io"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode"
 
 	"golang.org/x/tools/go/packages"
 )
@@ -20,7 +33,149 @@ import (
 type printOutput struct {
 	pkgName     string
 	pkgPath     string
-	definitions []string
+	definitions []*definition
+	unresolved  []unresolvedSymbol
+	symbols     []string // the input symbols looked up, in input order
+	related     []string
+	keepAll     bool
+	omitted     int
+	loadTime    time.Duration
+	extractTime time.Duration
+}
+
+type unresolvedSymbol struct {
+	Symbol string `json:"symbol"`
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+type definition struct {
+	symbols    []string
+	kind       string
+	pkgName    string
+	pkgPath    string
+	file       string
+	srcFile    string // the file offset and endOffset index, ignoring //line
+	startLine  int
+	startCol   int
+	endLine    int
+	endCol     int
+	offset     int
+	endOffset  int
+	name       string
+	receiver   string
+	source     string
+	fileHeader string
+	blame      string
+	imports    map[string]string // -format=go: import path by the name source refers to it by
+}
+
+type section struct {
+	label       string
+	title       string
+	pkgName     string
+	definitions []*definition
+	omitted     int
+}
+
+type options struct {
+	format                string
+	group                 string
+	withLineComments      bool
+	jobs                  int
+	firstMatchOnly        bool
+	unresolvedOut         string
+	withSection           bool
+	cacheDir              string
+	ignoreCase            bool
+	signatures            bool
+	autoRoot              bool
+	toc                   bool
+	outline               bool
+	methods               bool
+	implementations       bool
+	crossModule           bool
+	includeOnly           string
+	summary               bool
+	between               bool
+	annotate              bool
+	blame                 bool
+	prefer                string
+	outputDir             string
+	withDirectives        bool
+	compare               string
+	maxPackages           int
+	limitSymbols          int
+	indexOut              string
+	contextDecl           bool
+	csvSource             bool
+	onNotFound            string
+	withConstraints       bool
+	shortPkg              bool
+	noDedup               bool
+	expandInterfaces      bool
+	failEmpty             bool
+	progress              bool
+	lang                  string
+	mergeConsecutive      bool
+	encoding              string
+	withConstructor       bool
+	flatJSON              bool
+	emitSymbols           bool
+	mainPkg               string
+	includeTestExamples   bool
+	maxNodes              int
+	relativeTo            string
+	stream                bool
+	streamBatch           int
+	streamIdle            time.Duration
+	expandToType          bool
+	sortDefs              string
+	statsJSON             string
+	funcBody              bool
+	loadErrorsOK          bool
+	showRelations         bool
+	plainStyle            string
+	resolveEmbeddedFields bool
+	testVariant           string
+	inlineTypes           bool
+	divider               string
+	groupMethodsUnderType bool
+	resolveEmbed          bool
+	echoSymbols           bool
+	highlightDiff         string
+	dryRun                bool
+	mdPerDef              bool
+	pretty                bool
+	diffSource            bool
+	allMatches            bool
+	wrap                  int
+	perPackageLimit       int
+	includeFileHeader     bool
+	parser                string
+	failOn                stringList
+	withUnderlying        bool
+	watch                 bool
+	normalizeReceiver     bool
+	verbose               bool
+	excludeLicense        bool
+	licenseKeywords       string
+	profile               bool
+	onlyPackages          stringList
+	ignore                stringList
+	callGraph             *callGraph
+	includeKinds          map[string]bool
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
 }
 
 type functionKey struct {
@@ -29,213 +184,2664 @@ type functionKey struct {
 	isPtr        bool
 }
 
+type rangeSymbol struct {
+	pkgPath   string
+	file      string
+	startLine int
+	endLine   int
+}
+
+type valueSpec struct {
+	decl  *ast.GenDecl
+	spec  *ast.ValueSpec
+	index int
+}
+
 type packageIndex struct {
 	pkg          *packages.Package
+	opts         *options
+	mu           sync.Mutex
 	fileContents map[string][]byte
+	files        map[string]*ast.File // by the name of the file parsed, ignoring //line
 	funcDecls    map[functionKey]*ast.FuncDecl
 	typeSpecs    map[string]*ast.GenDecl
+	valueSpecs   map[string]valueSpec
+	initFuncs    []*ast.FuncDecl
+	changed      map[string]map[int]bool
+	exampleFuncs []exampleFunc
+	cgo          bool
 	fset         *token.FileSet
 }
 
 func main() {
-	formatFlag := flag.String("format", "plain", "output format: plain or markdown")
+	opts := &options{}
+	flag.StringVar(&opts.format, "format", "plain", "output format: plain, markdown, markdown-table, csv, ndjson, org, patch or go")
+	flag.BoolVar(&opts.flatJSON, "flat-json", false, "instead of -format, print one JSON array with an object per definition, ordered by package and position")
+	flag.BoolVar(&opts.csvSource, "csv-source", false, "with -format=csv, add each definition's source as a last column")
+	flag.BoolVar(&opts.annotate, "annotate", false, "prefix each definition with the input symbols that produced it")
+	flag.StringVar(&opts.relativeTo, "relative-to", "", "show file paths relative to this directory instead of the module root")
+	flag.StringVar(&opts.outputDir, "output-dir", "", "write each package's output to its own file in this directory instead of stdout")
+	flag.StringVar(&opts.mainPkg, "main-pkg", "", "directory of the command package that symbols of package main (main.run) resolve in, relative to the module root (default: the module root)")
+	flag.StringVar(&opts.prefer, "prefer", "func", "which declaration a name resolves to when a function and a type share it: func or type")
+	flag.BoolVar(&opts.allMatches, "all-matches", false, "print every declaration matching a name (function, type, var/const) and warn when there is more than one")
+	flag.BoolVar(&opts.blame, "blame", false, "prefix each definition with the most recent commit (git blame) touching its lines")
+	flag.BoolVar(&opts.toc, "toc", false, "prepend a table of contents to markdown output")
+	flag.StringVar(&opts.group, "group", "package", "group definitions by: package or file")
+	flag.BoolVar(&opts.between, "between", false, "print the source from the first input symbol through the second (same file)")
+	flag.StringVar(&opts.cacheDir, "cache-dir", "", "cache resolved package file sets in `dir` across runs")
+	flag.StringVar(&opts.includeOnly, "include-only", "", "comma-separated kinds to print: funcs, methods, types, vars, consts")
+	flag.BoolVar(&opts.includeFileHeader, "include-file-header", false, "print the comments above the package clause once per contributing file")
+	flag.BoolVar(&opts.excludeLicense, "exclude-license", false, "with -include-file-header, omit comment blocks that look like license headers")
+	flag.StringVar(&opts.licenseKeywords, "license-keywords", "Copyright,License,SPDX-License-Identifier", "comma-separated keywords that mark a license header for -exclude-license")
+	flag.BoolVar(&opts.ignoreCase, "ignore-case", false, "fall back to a unique case-insensitive match when no exact match exists")
+	flag.IntVar(&opts.jobs, "j", 1, "number of packages to load concurrently")
+	flag.BoolVar(&opts.failEmpty, "fail-empty", false, "exit non-zero if the input had symbols but no definition was printed")
+	flag.Var(&opts.failOn, "fail-on", "exit non-zero if a resolved symbol or its package matches `pattern` (path.Match, repeatable)")
+	flag.Var(&opts.onlyPackages, "only-packages", "only process symbols whose package path matches `pattern` (path.Match, repeatable)")
+	flag.Var(&opts.ignore, "ignore", "skip symbols whose package path matches `pattern` (path.Match, repeatable)")
+	flag.StringVar(&opts.parser, "parser", "default", "input symbol syntax: "+symbolParserNames())
+	flag.IntVar(&opts.perPackageLimit, "definitions-per-package-limit", 0, "print at most N definitions per package (0 means unlimited)")
+	flag.BoolVar(&opts.firstMatchOnly, "first-match-only", false, "emit only the first declaration matched by each symbol")
+	flag.BoolVar(&opts.stream, "stream", false, "extract symbols in batches as they are read instead of after the whole input")
+	flag.IntVar(&opts.streamBatch, "stream-batch", 100, "with -stream, extract a package as soon as this many of its symbols are buffered")
+	flag.DurationVar(&opts.streamIdle, "stream-idle", 500*time.Millisecond, "with -stream, extract everything buffered when no input arrives for this long")
+	flag.BoolVar(&opts.progress, "progress", false, "report on stderr how many packages and symbols have been resolved so far, in place on a terminal")
+	flag.BoolVar(&opts.profile, "profile", false, "print per-package load and extraction times to stderr")
+	flag.BoolVar(&opts.summary, "summary", false, "print resolution counts to stderr")
+	flag.StringVar(&opts.unresolvedOut, "unresolved-out", "", "write symbols that failed to parse or resolve as a JSON array to `path`")
+	flag.BoolVar(&opts.implementations, "implementations", false, "also print the types that implement requested interfaces")
+	flag.BoolVar(&opts.crossModule, "cross-module", false, "search dependencies as well as the module for -implementations")
+	flag.BoolVar(&opts.methods, "methods", false, "also print the methods of requested types")
+	flag.BoolVar(&opts.normalizeReceiver, "normalize-receiver", false, "drop receiver names from methods: func (*T) M()")
+	flag.BoolVar(&opts.outline, "outline", false, "print type declarations in full but collapse function bodies to { ... }")
+	flag.BoolVar(&opts.signatures, "signatures", false, "print only the signature of functions and methods")
+	flag.BoolVar(&opts.verbose, "v", false, "log extra diagnostics")
+	flag.BoolVar(&opts.watch, "watch", false, "keep running and reprint whenever a contributing source file changes")
+	flag.BoolVar(&opts.withUnderlying, "with-underlying", false, "append the underlying type of named types defined from other types")
+	flag.BoolVar(&opts.pretty, "pretty", false, "draw each section of -format=plain as a box as wide as the terminal (80 columns when not a terminal), with indented code")
+	flag.BoolVar(&opts.mdPerDef, "md-per-def", false, "in markdown, give each definition its own heading (its canonical symbol) and code block")
+	flag.BoolVar(&opts.dryRun, "dry-run", false, "print the packages that would be loaded and the symbols looked up in each, without loading anything")
+	flag.StringVar(&opts.highlightDiff, "highlight-diff", "", "prefix the lines of each definition that changed since this git revision with `// + `")
+	flag.BoolVar(&opts.emitSymbols, "emit-symbols", false, "instead of source, print the canonical form of every symbol that resolved, one per line, ordered by package and -sort-defs")
+	flag.BoolVar(&opts.echoSymbols, "echo-symbols", false, "print the canonical form of each input symbol as parsed, one per line, without loading any package")
+	flag.BoolVar(&opts.resolveEmbed, "resolve-embed", false, "after a var with //go:embed directives, list the files (relative to the package directory) its patterns match")
+	flag.BoolVar(&opts.groupMethodsUnderType, "group-methods-under-type", false, "in markdown, split each section into a #### subsection per type (the type, then its methods) and one for functions and values")
+	flag.BoolVar(&opts.shortPkg, "short-pkg", false, "title package sections with the package name instead of the import path, adding just enough of the path to tell packages with the same name apart")
+	flag.StringVar(&opts.divider, "divider", strings.Repeat("-", 50), "line printed above and below each section of -format=plain; empty for none")
+	flag.BoolVar(&opts.expandInterfaces, "expand-interfaces", false, "also print the interfaces embedded in a requested interface, recursively, from any package")
+	flag.BoolVar(&opts.withConstructor, "with-constructor", false, "with a type, also print its constructor: a function NewT or newT of the package returning T or *T")
+	flag.IntVar(&opts.maxNodes, "max-nodes", 0, "with -with-constraints or -expand-interfaces, add at most N related declarations in total, logging how many were left out (0 means unlimited)")
+	flag.BoolVar(&opts.withConstraints, "with-constraints", false, "also print the declarations of the named constraints of a generic function's or type's type parameters")
+	flag.BoolVar(&opts.inlineTypes, "inline-types", false, "prefix functions with a `// type X = ...` line giving the underlying type of each named type in their signature")
+	flag.StringVar(&opts.lang, "lang", "", "select files by the build constraints of this Go version (e.g. go1.21) instead of the installed toolchain's; packages are then parsed without type information")
+	flag.BoolVar(&opts.includeTestExamples, "include-test-examples", false, "after a function, type or method, print the Example functions of the package's tests that document it (ExampleF, ExampleT_M, ExampleF_suffix)")
+	flag.StringVar(&opts.testVariant, "test-variant", "", "load packages with their tests and resolve symbols in the internal test variant, the external _test package, or both")
+	flag.BoolVar(&opts.resolveEmbeddedFields, "resolve-embedded-fields", false, "resolve package/path.Type.Field to a field promoted from an embedded struct, printed from the struct that declares it")
+	flag.StringVar(&opts.plainStyle, "plain-style", "full", "layout of -format=plain: full (dividers and a package clause per section) or compact (a # header per section)")
+	flag.BoolVar(&opts.showRelations, "show-relations", false, "prefix each definition with its direct callers and callees from the caller -> callee edges in the input")
+	flag.StringVar(&opts.onNotFound, "on-not-found", "skip", "what to do with a symbol no declaration is found for: skip (log it), error (stop with a non-zero exit) or stub (print a // TODO placeholder)")
+	flag.StringVar(&opts.encoding, "encoding", "utf-8", "encoding of the source files, converted to UTF-8 for printing: utf-8, latin1 (iso-8859-1) or windows-1252")
+	flag.BoolVar(&opts.loadErrorsOK, "load-errors-ok", false, "extract from packages that have type or syntax errors, using the files that parsed; errors are logged as warnings")
+	flag.BoolVar(&opts.contextDecl, "context-decl", false, "print the whole var or const group around a requested name, marking its line with // <-- requested")
+	flag.BoolVar(&opts.funcBody, "func-body", false, "for a var whose value is a function literal, print just the literal (func ... { ... })")
+	flag.StringVar(&opts.indexOut, "index-out", "", "write a JSON object mapping each resolved symbol to the file, start/end line and column and kind of its definition to this file")
+	flag.StringVar(&opts.statsJSON, "stats-json", "", "write a JSON object with symbol counts and per-package definition counts to this file")
+	flag.BoolVar(&opts.mergeConsecutive, "merge-consecutive", false, "print definitions separated only by blank lines and comments in their file as one snippet, keeping what lies between them")
+	flag.StringVar(&opts.sortDefs, "sort-defs", "position", "order of definitions within a package: position (file, then line), name or input")
+	flag.BoolVar(&opts.expandToType, "expand-to-type", false, "for a requested method, print its receiver type followed by all of the type's methods instead")
+	flag.BoolVar(&opts.noDedup, "no-dedup", false, "process every occurrence of a symbol in the input, printing its definition once per occurrence")
+	flag.IntVar(&opts.limitSymbols, "limit-symbols", 0, "process only the first N unique input symbols, ignoring the rest (0 means unlimited)")
+	flag.IntVar(&opts.maxPackages, "max-packages", 0, "load at most N distinct packages, in input order, skipping the rest (0 means unlimited)")
+	flag.StringVar(&opts.compare, "compare", "", "compare the input symbols with the baseline symbols in this file and print the added (+), removed (-) and common ones per package")
+	flag.BoolVar(&opts.diffSource, "diff-source", false, "with -compare, also print the source of the added and removed symbols")
+	flag.BoolVar(&opts.withDirectives, "with-directives", false, "include //go: directive lines (e.g. //go:generate) from the comments above each declaration")
+	flag.BoolVar(&opts.withSection, "with-section", false, "include the nearest preceding standalone section comment")
+	flag.IntVar(&opts.wrap, "wrap", 0, "re-wrap // comment lines to at most N columns (0 disables)")
+	flag.BoolVar(&opts.withLineComments, "with-line-comments", false, "include a trailing comment on the last line of a declaration")
 	flag.Parse()
 	args := flag.Args()
 
-	if len(args) < 1 {
-		log.Fatalf("Usage: %s <module-root>\n", os.Args[0])
+	if len(args) > 1 {
+		log.Fatalf("Usage: %s [module-root]\n", os.Args[0])
+	}
+	if opts.lang != "" {
+		if _, err := releaseTags(opts.lang); err != nil {
+			log.Fatalf("-lang: %v", err)
+		}
+	}
+	if opts.relativeTo != "" {
+		abs, err := filepath.Abs(opts.relativeTo)
+		if err != nil {
+			log.Fatalf("-relative-to: %v", err)
+		}
+		opts.relativeTo = abs
+	}
+	if err := checkEncoding(opts.encoding); err != nil {
+		log.Fatalf("-encoding: %v", err)
+	}
+	if opts.normalizeReceiver && !opts.signatures && !opts.outline {
+		log.Fatalf("-normalize-receiver needs -signatures or -outline: a method body may use the receiver name")
+	}
+	if opts.onNotFound != "skip" && opts.onNotFound != "error" && opts.onNotFound != "stub" {
+		log.Fatalf("unknown -on-not-found %q: must be skip, error or stub", opts.onNotFound)
+	}
+	if opts.group != "package" && opts.group != "file" {
+		log.Fatalf("unknown group %q: must be package or file", opts.group)
+	}
+	if opts.testVariant != "" && opts.testVariant != "internal" && opts.testVariant != "external" && opts.testVariant != "both" {
+		log.Fatalf("unknown test-variant %q: must be internal, external or both", opts.testVariant)
+	}
+	if opts.plainStyle != "full" && opts.plainStyle != "compact" {
+		log.Fatalf("unknown plain-style %q: must be full or compact", opts.plainStyle)
+	}
+	if opts.sortDefs != "position" && opts.sortDefs != "name" && opts.sortDefs != "input" {
+		log.Fatalf("unknown sort-defs %q: must be position, name or input", opts.sortDefs)
+	}
+	if opts.prefer != "func" && opts.prefer != "type" {
+		log.Fatalf("unknown prefer %q: must be func or type", opts.prefer)
+	}
+	for flagName, patterns := range map[string][]string{"fail-on": opts.failOn, "only-packages": opts.onlyPackages, "ignore": opts.ignore} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				log.Fatalf("invalid -%s pattern %q: %v", flagName, pattern, err)
+			}
+		}
+	}
+	includeKinds, err := parseKinds(opts.includeOnly)
+	if err != nil {
+		log.Fatalf("invalid -include-only: %v", err)
+	}
+	opts.includeKinds = includeKinds
+	parser, err := newSymbolParser(opts.parser)
+	if err != nil {
+		log.Fatalf("invalid -parser: %v", err)
+	}
+	if opts.showRelations {
+		opts.callGraph = newCallGraph()
+	}
+	if opts.stream {
+		if conflicts := streamConflicts(opts); len(conflicts) > 0 {
+			log.Fatalf("-stream cannot be combined with %s, which need the whole input", strings.Join(conflicts, ", "))
+		}
+		absRoot, err := filepath.Abs(moduleRoot(args, opts))
+		if err != nil {
+			log.Fatalf("failed to get absolute module root path: %v", err)
+		}
+		code, err := streamExtract(os.Stdin, parser, absRoot, opts)
+		if err != nil {
+			log.Fatalf("failed to read symbols: %v", err)
+		}
+		if code != 0 {
+			os.Exit(code)
+		}
+		return
+	}
+	symbols, err := readSymbolsFromStdin(parser, opts.callGraph)
+	if err != nil {
+		log.Fatalf("failed to read symbols: %v", err)
+	}
+	if opts.echoSymbols {
+		echoSymbols(os.Stdout, symbols)
+		return
+	}
+	if opts.compare != "" {
+		baseline, err := readSymbolsFromFile(opts.compare, parser)
+		if err != nil {
+			log.Fatalf("failed to read -compare symbols: %v", err)
+		}
+		added, removed := compareSymbols(os.Stdout, symbols, baseline)
+		if !opts.diffSource || len(added)+len(removed) == 0 {
+			return
+		}
+		fmt.Println()
+		symbols = append(added, removed...)
+	}
+	if len(symbols) == 0 {
+		log.Println("No symbols found in input")
+		return
+	}
+	if opts.dryRun {
+		printPlan(os.Stdout, planExtraction(symbols, opts))
+		return
+	}
+
+	// Only modes that load packages need a module root.
+	absRoot, err := filepath.Abs(moduleRoot(args, opts))
+	if err != nil {
+		log.Fatalf("failed to get absolute module root path: %v", err)
+	}
+
+	if opts.watch {
+		if err := watch(symbols, absRoot, opts); err != nil {
+			log.Fatalf("-watch: %v", err)
+		}
+		return
+	}
+	if _, code := extract(symbols, absRoot, opts); code != 0 {
+		os.Exit(code)
+	}
+}
+
+// extractPlan is the parsed, deduplicated and filtered input, grouped by
+// package; building it needs no package loading.
+type extractPlan struct {
+	symbolsByPkg map[string][]string
+	pkgOrder     []string
+	unique       int
+	unresolved   []unresolvedSymbol
+}
+
+func planExtraction(symbols []string, opts *options) *extractPlan {
+	plan := &extractPlan{symbolsByPkg: make(map[string][]string)}
+	seen := make(map[string]bool)
+	dropped, limited := 0, 0
+
+	for _, sym := range symbols {
+		if seen[sym] && !opts.noDedup {
+			continue
+		}
+		seen[sym] = true
+		if opts.limitSymbols > 0 && len(seen) > opts.limitSymbols {
+			limited++
+			continue
+		}
+
+		rs, rangeErr := parseRangeSymbol(sym)
+		if rangeErr != nil {
+			log.Printf("skip symbol %q: %v\n", sym, rangeErr)
+			plan.unresolved = append(plan.unresolved, newUnresolved(sym, "parse_error", rangeErr))
+			continue
+		}
+		var pkgPath string
+		if rs != nil {
+			pkgPath = rs.pkgPath
+		} else {
+			var parseErr error
+			pkgPath, _, _, _, parseErr = parseSymbol(sym)
+			if parseErr != nil {
+				log.Printf("skip symbol %q: %v\n", sym, parseErr)
+				plan.unresolved = append(plan.unresolved, newUnresolved(sym, "parse_error", parseErr))
+				continue
+			}
+		}
+		if !packageAllowed(pkgPath, opts) {
+			dropped++
+			continue
+		}
+		if _, ok := plan.symbolsByPkg[pkgPath]; !ok {
+			plan.pkgOrder = append(plan.pkgOrder, pkgPath)
+		}
+		plan.symbolsByPkg[pkgPath] = append(plan.symbolsByPkg[pkgPath], sym)
+	}
+	plan.unique = len(seen) - limited
+	if dropped > 0 {
+		log.Printf("dropped %d symbols by -only-packages/-ignore\n", dropped)
+	}
+	if limited > 0 {
+		log.Printf("dropped %d symbols beyond -limit-symbols=%d\n", limited, opts.limitSymbols)
+	}
+	if opts.maxPackages > 0 && len(plan.pkgOrder) > opts.maxPackages {
+		skipped := plan.pkgOrder[opts.maxPackages:]
+		log.Printf("input references %d packages, more than -max-packages=%d; skipping:\n  %s\n", len(plan.pkgOrder), opts.maxPackages, strings.Join(skipped, "\n  "))
+		for _, pkgPath := range skipped {
+			for _, sym := range plan.symbolsByPkg[pkgPath] {
+				plan.unresolved = append(plan.unresolved, newUnresolved(sym, "package_limit", nil))
+			}
+			delete(plan.symbolsByPkg, pkgPath)
+		}
+		plan.pkgOrder = plan.pkgOrder[:opts.maxPackages]
+	}
+	return plan
+}
+
+// printPlan prints, for -dry-run, the packages that would be loaded and the
+// symbols looked up in each, in input order.
+func printPlan(w io.Writer, plan *extractPlan) {
+	for _, pkgPath := range plan.pkgOrder {
+		fmt.Fprintf(w, "%s\n", pkgPath)
+		for _, sym := range plan.symbolsByPkg[pkgPath] {
+			fmt.Fprintf(w, "  %s\n", sym)
+		}
+	}
+	n := 0
+	for _, syms := range plan.symbolsByPkg {
+		n += len(syms)
+	}
+	fmt.Fprintf(w, "%d packages, %d symbols, %d unparsed or skipped\n", len(plan.pkgOrder), n, len(plan.unresolved))
+}
+
+func extract(symbols []string, absRoot string, opts *options) (map[string]*printOutput, int) {
+	plan := planExtraction(symbols, opts)
+	symbolsByPkg := plan.symbolsByPkg
+	unresolved := plan.unresolved
+
+	indexes := newIndexCache()
+	resolveStart := time.Now()
+	results := resolvePackages(absRoot, symbolsByPkg, indexes, opts)
+	resolveTime := time.Since(resolveStart)
+	if opts.verbose {
+		log.Printf("package indexes: %d built, %d reused\n", indexes.built, indexes.reused)
+	}
+	if err := checkNotFound(results, opts); err != nil {
+		log.Printf("-on-not-found=error: %v\n", err)
+		return results, 1
+	}
+	if opts.withConstraints || opts.expandInterfaces {
+		addRelated(absRoot, results, indexes, opts)
+	}
+	if opts.implementations {
+		addImplementations(absRoot, symbolsByPkg, results, opts)
+	}
+	if opts.firstMatchOnly {
+		keepFirstMatches(results)
+	}
+	if opts.between {
+		if err := mergeBetween(results, symbols); err != nil {
+			log.Printf("-between: %v\n", err)
+			return results, 1
+		}
+	}
+	filtered := 0
+	if len(opts.includeKinds) > 0 {
+		filtered = filterKinds(results, opts.includeKinds)
+	}
+	if opts.perPackageLimit > 0 {
+		limitDefinitions(results, opts.perPackageLimit)
+	}
+	sortDefinitions(results, opts.sortDefs)
+	if opts.mergeConsecutive {
+		mergeConsecutive(results, opts.encoding)
+	}
+	if opts.blame {
+		addBlame(results)
+	}
+	if opts.unresolvedOut != "" {
+		if err := writeUnresolved(opts.unresolvedOut, unresolved, results); err != nil {
+			log.Printf("failed to write unresolved symbols: %v\n", err)
+		}
+	}
+
+	group := opts.group
+	if opts.format == "patch" {
+		group = "file"
+	}
+	if opts.format == "go" {
+		group = "package"
+	}
+	// File paths are shown relative to the module root unless -relative-to
+	// names another base.
+	displayRoot := absRoot
+	if opts.relativeTo != "" {
+		displayRoot = opts.relativeTo
+	}
+	if opts.outputDir != "" {
+		if err := writePackageFiles(opts.outputDir, results, group, displayRoot, opts); err != nil {
+			log.Printf("failed to write -output-dir: %v\n", err)
+			return results, 1
+		}
+	} else {
+		render(os.Stdout, results, group, displayRoot, opts)
+	}
+
+	if opts.summary {
+		printSummary(os.Stderr, len(symbols), plan.unique, results, unresolved, filtered)
+	}
+	if opts.statsJSON != "" {
+		if err := writeStats(opts.statsJSON, len(symbols), plan.unique, results, unresolved, filtered); err != nil {
+			log.Printf("failed to write stats: %v\n", err)
+		}
+	}
+	if opts.indexOut != "" {
+		if err := writeIndex(opts.indexOut, results); err != nil {
+			log.Printf("failed to write -index-out: %v\n", err)
+		}
+	}
+	if opts.profile {
+		printProfile(os.Stderr, results, resolveTime)
+	}
+	if opts.failEmpty && countDefinitions(results) == 0 {
+		log.Printf("-fail-empty: none of the %d input symbols produced a definition; check the module root and that the packages build\n", len(symbols))
+		return results, 1
+	}
+	if offenders := matchFailOn(results, opts.failOn); len(offenders) > 0 {
+		log.Printf("resolved symbols matching -fail-on:\n  %s\n", strings.Join(offenders, "\n  "))
+		return results, 1
+	}
+	return results, 0
+}
+
+func countDefinitions(results map[string]*printOutput) int {
+	n := 0
+	for _, out := range results {
+		n += len(out.definitions)
+	}
+	return n
+}
+
+func packageAllowed(pkgPath string, opts *options) bool {
+	if len(opts.onlyPackages) > 0 && !matchAny(opts.onlyPackages, pkgPath) {
+		return false
+	}
+	return !matchAny(opts.ignore, pkgPath)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchFailOn(results map[string]*printOutput, patterns []string) []string {
+	if len(patterns) == 0 {
+		return nil
+	}
+	var offenders []string
+	seen := make(map[string]bool)
+	for _, out := range results {
+		for _, def := range out.definitions {
+			for _, sym := range def.symbols {
+				if seen[sym] {
+					continue
+				}
+				for _, pattern := range patterns {
+					pkgMatch, _ := path.Match(pattern, def.pkgPath)
+					symMatch, _ := path.Match(pattern, sym)
+					if pkgMatch || symMatch {
+						seen[sym] = true
+						offenders = append(offenders, sym)
+						break
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(offenders)
+	return offenders
+}
+
+func resolvePackages(absRoot string, symbolsByPkg map[string][]string, indexes *indexCache, opts *options) map[string]*printOutput {
+	pkgPaths := make([]string, 0, len(symbolsByPkg))
+	for p := range symbolsByPkg {
+		pkgPaths = append(pkgPaths, p)
+	}
+	sort.Strings(pkgPaths)
+
+	jobs := opts.jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	var prog *progress
+	if opts.progress {
+		total := 0
+		for _, syms := range symbolsByPkg {
+			total += len(syms)
+		}
+		prog = startProgress(len(pkgPaths), total)
+	}
+
+	// Each worker fills only its own slot; the map is assembled after Wait.
+	outputs := make([]*printOutput, len(pkgPaths))
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, pkgPath := range pkgPaths {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			outputs[i] = resolvePackage(absRoot, pkgPath, symbolsByPkg[pkgPath], indexes, opts)
+			if prog != nil {
+				prog.done(len(symbolsByPkg[pkgPath]))
+			}
+		}()
+	}
+	wg.Wait()
+	if prog != nil {
+		prog.stop()
+	}
+
+	results := make(map[string]*printOutput, len(outputs))
+	for _, out := range outputs {
+		if out == nil {
+			continue
+		}
+		// Nested symbols may resolve into a package that was also requested
+		// directly.
+		if prev, ok := results[out.pkgPath]; ok {
+			for _, def := range out.definitions {
+				for _, sym := range def.symbols {
+					prev.addDefinition(sym, def)
+				}
+			}
+			prev.unresolved = append(prev.unresolved, out.unresolved...)
+			prev.loadTime += out.loadTime
+			prev.extractTime += out.extractTime
+			continue
+		}
+		results[out.pkgPath] = out
+	}
+	return results
+}
+
+func resolvePackage(absRoot, pkgPath string, syms []string, indexes *indexCache, opts *options) *printOutput {
+	out := &printOutput{
+		pkgPath:     pkgPath,
+		definitions: []*definition{},
+		symbols:     syms,
+		keepAll:     opts.noDedup,
+	}
+
+	loadStart := time.Now()
+	// `main.run` names the command package in the module root or -main-pkg.
+	loadPath := pkgPath
+	if pkgPath == "main" {
+		loadPath = mainPackageDir(opts.mainPkg)
+	}
+	pkg, err := loadPackage(absRoot, loadPath, opts)
+	if pkgPath == "main" {
+		if err == nil && pkg.Name != "main" {
+			err = fmt.Errorf("%s holds package %s, not a main package: use -main-pkg DIR", loadPath, pkg.Name)
+		} else if err != nil && opts.mainPkg == "" {
+			err = fmt.Errorf("%w (package main is looked up in the module root; use -main-pkg DIR)", err)
+		}
+	}
+	// `mod/v2.T.M` splits into the package `mod/v2.T`; when that does not
+	// load, retry with the last element read as a receiver type.
+	nestedRecv := ""
+	if err != nil {
+		if parent, recv, ok := splitNestedReceiver(pkgPath); ok {
+			if parentPkg, parentErr := loadPackage(absRoot, parent, opts); parentErr == nil {
+				pkg, err, nestedRecv = parentPkg, nil, recv
+				out.pkgPath = parent
+			}
+		}
+	}
+	out.loadTime = time.Since(loadStart)
+	if err != nil {
+		log.Printf("failed to load package %q: %v\n", pkgPath, err)
+		for _, sym := range syms {
+			out.addUnresolved(sym, "load_error", err)
+		}
+		return out
+	}
+	out.pkgName = pkg.Name
+	if isFilesystemPath(loadPath) {
+		out.pkgPath = pkg.PkgPath
+	}
+
+	extractStart := time.Now()
+	defer func() { out.extractTime = time.Since(extractStart) }()
+	idx := indexes.get(pkg, opts)
+
+	for _, sym := range syms {
+		if rs, _ := parseRangeSymbol(sym); rs != nil {
+			decls, err := idx.declsInRange(rs.file, rs.startLine, rs.endLine)
+			if err != nil {
+				out.notFound(sym, err, opts, fmt.Sprintf("skip symbol %q: %v", sym, err))
+				continue
+			}
+			if len(decls) == 0 {
+				out.notFound(sym, nil, opts, fmt.Sprintf("No declaration overlaps range %q", sym))
+				continue
+			}
+			for _, decl := range decls {
+				def, err := idx.newDeclDefinition(decl)
+				if err != nil {
+					log.Printf("failed to extract source of %q: %v\n", sym, err)
+					out.addUnresolved(sym, "extract_error", err)
+					continue
+				}
+				out.addDefinition(sym, def)
+			}
+			continue
+		}
+
+		_, receiverType, isPtr, funcOrTypeName, err := parseSymbol(sym)
+		if err != nil {
+			log.Printf("skip symbol %q: %v\n", sym, err)
+			out.addUnresolved(sym, "parse_error", err)
+			continue
+		}
+
+		if nestedRecv != "" && receiverType == "" {
+			receiverType = nestedRecv
+		}
+		if funcOrTypeName == "init" && receiverType == "" {
+			idx.addInitFuncs(out, sym)
+			continue
+		}
+		key := functionKey{
+			funcName:     funcOrTypeName,
+			receiverType: receiverType,
+			isPtr:        isPtr,
+		}
+		hint, _ := splitKindHint(sym)
+		def, found, err := idx.resolveHinted(key, hint)
+		if !found && err == nil && nestedRecv != "" {
+			key.isPtr = true
+			def, found, err = idx.resolveHinted(key, hint)
+		}
+		if !found && err == nil && nestedRecv != "" {
+			def, found, err = idx.resolveField(nestedRecv, funcOrTypeName)
+		}
+		if !found && opts.ignoreCase {
+			if folded, ok := idx.foldKey(key); ok {
+				log.Printf("using case-insensitive match %q for symbol %q\n", folded.funcName, sym)
+				key = folded
+				def, found, err = idx.resolveHinted(key, hint)
+			}
+		}
+		if _, line := stripPosition(sym); found && err == nil && line > 0 {
+			// Prefer the declaration whose span contains the given line.
+			if d, ok, lineErr := idx.declarationAt(key, line); lineErr == nil && ok {
+				def = d
+			}
+		}
+		if err != nil {
+			log.Printf("failed to extract source of %q: %v\n", sym, err)
+			out.addUnresolved(sym, "extract_error", err)
+			continue
+		}
+		if found {
+			if def.kind == "type" && opts.withUnderlying {
+				if u, ok := idx.underlyingOf(key.funcName); ok {
+					def.source += "\n// underlying: " + u
+				}
+			}
+			if opts.expandToType && def.kind == "method" {
+				if typeDef, ok, err := idx.lookupType(functionKey{funcName: key.receiverType}); err == nil && ok {
+					out.addDefinition(sym, typeDef)
+					idx.addMethods(out, sym, key.receiverType)
+					continue
+				}
+			}
+			if opts.includeTestExamples {
+				def.source += idx.exampleSource(key)
+			}
+			out.addDefinition(sym, def)
+			if opts.withConstraints {
+				out.related = append(out.related, idx.constraintsOf(key)...)
+			}
+			if opts.withConstructor && def.kind == "type" {
+				for _, fn := range idx.constructorsOf(key.funcName) {
+					if ctor, err := idx.newDeclDefinition(fn); err == nil {
+						out.addDefinition(sym, ctor)
+					}
+				}
+			}
+			if opts.expandInterfaces && def.kind == "type" {
+				out.related = append(out.related, idx.embeddedInterfacesOf(key.funcName)...)
+			}
+			if opts.allMatches {
+				if defs, err := idx.resolveMatches(key, true); err == nil && len(defs) > 1 {
+					log.Printf("symbol %q is ambiguous: printing all %d matching declarations\n", sym, len(defs))
+					for _, d := range defs[1:] {
+						out.addDefinition(sym, d)
+					}
+				}
+			}
+			if _, isType := idx.typeSpecs[key.funcName]; opts.methods && isType && key.receiverType == "" {
+				idx.addMethods(out, sym, key.funcName)
+			}
+			continue
+		}
+
+		out.notFound(sym, nil, opts, fmt.Sprintf("No matching function or type declaration found for symbol %q", sym))
+	}
+	return out
+}
+
+func mergeBetween(results map[string]*printOutput, symbols []string) error {
+	var uniq []string
+	seen := make(map[string]bool)
+	for _, sym := range symbols {
+		if !seen[sym] {
+			seen[sym] = true
+			uniq = append(uniq, sym)
+		}
+	}
+	if len(uniq) != 2 {
+		return fmt.Errorf("expected exactly two symbols, got %d", len(uniq))
+	}
+
+	var first, last *definition
+	var out *printOutput
+	for _, o := range results {
+		for _, def := range o.definitions {
+			if def.hasSymbol(uniq[0]) && first == nil {
+				first, out = def, o
+			}
+			if def.hasSymbol(uniq[1]) && last == nil {
+				last = def
+			}
+		}
+	}
+	if first == nil || last == nil {
+		return errors.New("both symbols must resolve")
+	}
+	if first.srcFile != last.srcFile {
+		return fmt.Errorf("%s and %s are in different files", uniq[0], uniq[1])
+	}
+	if first.offset > last.offset {
+		return fmt.Errorf("%s comes after %s in %s", uniq[0], uniq[1], first.file)
+	}
+
+	content, err := os.ReadFile(first.srcFile)
+	if err != nil {
+		return err
+	}
+	if last.endOffset > len(content) {
+		return fmt.Errorf("file '%s' changed since it was parsed", first.srcFile)
+	}
+	merged := *first
+	merged.endLine = last.endLine
+	merged.endOffset = last.endOffset
+	merged.source = string(content[first.offset:last.endOffset])
+
+	for k := range results {
+		delete(results, k)
+	}
+	out.definitions = []*definition{&merged}
+	results[out.pkgPath] = out
+	return nil
+}
+
+func parseKinds(list string) (map[string]bool, error) {
+	kinds := make(map[string]bool)
+	for _, k := range strings.Split(list, ",") {
+		switch strings.TrimSpace(k) {
+		case "":
+		case "funcs":
+			kinds["func"] = true
+			kinds["method"] = true
+		case "methods":
+			kinds["method"] = true
+		case "types":
+			kinds["type"] = true
+		case "vars":
+			kinds["var"] = true
+		case "consts":
+			kinds["const"] = true
+		default:
+			return nil, fmt.Errorf("unknown kind %q: must be funcs, methods, types, vars or consts", k)
+		}
+	}
+	return kinds, nil
+}
+
+func filterKinds(results map[string]*printOutput, kinds map[string]bool) int {
+	filtered := 0
+	for _, out := range results {
+		kept := out.definitions[:0]
+		for _, def := range out.definitions {
+			if kinds[def.kind] {
+				kept = append(kept, def)
+			} else {
+				filtered++
+			}
+		}
+		out.definitions = kept
+	}
+	return filtered
+}
+
+func printSummary(w io.Writer, inputSymbols, uniqueSymbols int, results map[string]*printOutput, unresolved []unresolvedSymbol, filtered int) {
+	definitions, pkgs := 0, 0
+	failed := len(unresolved)
+	for _, out := range results {
+		definitions += len(out.definitions)
+		if len(out.definitions) > 0 {
+			pkgs++
+		}
+		failed += len(out.unresolved)
+	}
+	fmt.Fprintf(w, "symbols:     %d input, %d unique\n", inputSymbols, uniqueSymbols)
+	fmt.Fprintf(w, "resolved:    %d definitions in %d packages\n", definitions, pkgs)
+	fmt.Fprintf(w, "unresolved:  %d\n", failed)
+	if filtered > 0 {
+		fmt.Fprintf(w, "filtered:    %d (-include-only)\n", filtered)
+	}
+}
+
+func printProfile(w io.Writer, results map[string]*printOutput, wall time.Duration) {
+	pkgPaths := make([]string, 0, len(results))
+	for p := range results {
+		pkgPaths = append(pkgPaths, p)
+	}
+	sort.Strings(pkgPaths)
+
+	var load, extract time.Duration
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "package\tload\textract\tdefinitions\t")
+	for _, p := range pkgPaths {
+		out := results[p]
+		load += out.loadTime
+		extract += out.extractTime
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t\n", p, roundDuration(out.loadTime), roundDuration(out.extractTime), len(out.definitions))
+	}
+	fmt.Fprintf(tw, "total\t%s\t%s\t\t\n", roundDuration(load), roundDuration(extract))
+	fmt.Fprintf(tw, "wall\t%s\t\t\t\n", roundDuration(wall))
+	tw.Flush()
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
+
+func keepFirstMatches(results map[string]*printOutput) {
+	var all []*definition
+	for _, out := range results {
+		all = append(all, out.definitions...)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		a, b := all[i], all[j]
+		if a.pkgPath != b.pkgPath {
+			return a.pkgPath < b.pkgPath
+		}
+		if a.file != b.file {
+			return a.file < b.file
+		}
+		return a.offset < b.offset
+	})
+
+	first := make(map[*definition]bool)
+	seen := make(map[string]bool)
+	for _, def := range all {
+		for _, sym := range def.symbols {
+			if !seen[sym] {
+				seen[sym] = true
+				first[def] = true
+			}
+		}
+	}
+
+	for _, out := range results {
+		kept := out.definitions[:0]
+		for _, def := range out.definitions {
+			if first[def] {
+				kept = append(kept, def)
+			}
+		}
+		out.definitions = kept
+	}
+}
+
+func buildSections(results map[string]*printOutput, group, absRoot string) []*section {
+	pkgPaths := make([]string, 0, len(results))
+	for p, out := range results {
+		if len(out.definitions) == 0 {
+			continue
+		}
+		pkgPaths = append(pkgPaths, p)
+	}
+	sort.Strings(pkgPaths)
+
+	if group != "file" {
+		sections := make([]*section, 0, len(pkgPaths))
+		for _, pkgKey := range pkgPaths {
+			out := results[pkgKey]
+			sections = append(sections, &section{
+				label:       "Package",
+				title:       out.pkgPath,
+				pkgName:     out.pkgName,
+				definitions: out.definitions,
+				omitted:     out.omitted,
+			})
+		}
+		return sections
+	}
+
+	byFile := make(map[string]*section)
+	for _, pkgKey := range pkgPaths {
+		if n := results[pkgKey].omitted; n > 0 {
+			log.Printf("%s: %d more definitions omitted by the per-package limit\n", pkgKey, n)
+		}
+		for _, def := range results[pkgKey].definitions {
+			sec, ok := byFile[def.file]
+			if !ok {
+				sec = &section{
+					label:   "File",
+					title:   displayPath(absRoot, def.file),
+					pkgName: def.pkgName,
+				}
+				byFile[def.file] = sec
+			}
+			sec.definitions = append(sec.definitions, def)
+		}
+	}
+
+	files := make([]string, 0, len(byFile))
+	for f := range byFile {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+
+	sections := make([]*section, 0, len(files))
+	for _, f := range files {
+		sec := byFile[f]
+		sort.SliceStable(sec.definitions, func(i, j int) bool {
+			return sec.definitions[i].offset < sec.definitions[j].offset
+		})
+		sections = append(sections, sec)
+	}
+	return sections
+}
+
+func render(w io.Writer, results map[string]*printOutput, group, absRoot string, opts *options) {
+	// Stubs are not resolved symbols, so -emit-symbols never sees them.
+	if opts.emitSymbols {
+		emitSymbols(w, results)
+		return
+	}
+	if opts.onNotFound == "stub" {
+		results = withStubs(results)
+	}
+	if opts.format == "markdown-table" {
+		printSymbolTable(w, results, absRoot)
+		return
+	}
+	if opts.format == "csv" {
+		if err := writeSymbolCSV(w, results, absRoot, opts.csvSource); err != nil {
+			log.Printf("failed to write csv: %v\n", err)
+		}
+		return
+	}
+	if opts.flatJSON {
+		if err := writeFlatJSON(w, results, absRoot); err != nil {
+			log.Printf("failed to write -flat-json: %v\n", err)
+		}
+		return
+	}
+	if opts.format == "ndjson" {
+		if err := writeNDJSON(w, results, absRoot); err != nil {
+			log.Printf("failed to write ndjson: %v\n", err)
+		}
+		return
+	}
+	sections := buildSections(results, group, absRoot)
+	if opts.shortPkg && group != "file" {
+		shortenTitles(sections)
+	}
+	printSections(w, sections, opts)
+}
+
+// shortenTitles replaces the import path titles of package sections with
+// the package name, or, for packages sharing a name, with the shortest
+// trailing part of the import path that tells them apart.
+func shortenTitles(sections []*section) {
+	byName := make(map[string][]*section)
+	for _, sec := range sections {
+		byName[sec.pkgName] = append(byName[sec.pkgName], sec)
+	}
+	for name, secs := range byName {
+		if len(secs) == 1 {
+			secs[0].title = name
+			continue
+		}
+		for n := 1; ; n++ {
+			titles := make(map[string]bool)
+			for _, sec := range secs {
+				titles[pathSuffix(sec.title, n)] = true
+			}
+			if len(titles) == len(secs) || n > strings.Count(secs[0].title, "/") {
+				for _, sec := range secs {
+					sec.title = pathSuffix(sec.title, n)
+				}
+				break
+			}
+		}
+	}
+}
+
+// pathSuffix returns the last n elements of the slash-separated path p.
+func pathSuffix(p string, n int) string {
+	parts := strings.Split(p, "/")
+	if n < len(parts) {
+		parts = parts[len(parts)-n:]
+	}
+	return strings.Join(parts, "/")
+}
+
+type definitionRecord struct {
+	Symbol    string   `json:"symbol"`
+	Symbols   []string `json:"symbols"`
+	PkgPath   string   `json:"pkgPath"`
+	Kind      string   `json:"kind"`
+	File      string   `json:"file"`
+	StartLine int      `json:"startLine"`
+	EndLine   int      `json:"endLine"`
+	Source    string   `json:"source"`
+}
+
+// writeNDJSON writes one JSON object per line and definition, package by
+// package in the order of the definitions within each. It runs once every
+// package has been resolved, like the other formats.
+func writeNDJSON(w io.Writer, results map[string]*printOutput, absRoot string) error {
+	pkgPaths := make([]string, 0, len(results))
+	for p := range results {
+		pkgPaths = append(pkgPaths, p)
+	}
+	sort.Strings(pkgPaths)
+	for _, p := range pkgPaths {
+		for _, def := range results[p].definitions {
+			b, err := json.Marshal(definitionRecord{
+				Symbol:    def.symbols[0],
+				Symbols:   def.symbols,
+				PkgPath:   def.pkgPath,
+				Kind:      def.kind,
+				File:      displayPath(absRoot, def.file),
+				StartLine: def.startLine,
+				EndLine:   def.endLine,
+				Source:    def.source,
+			})
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(append(b, '\n')); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type flatRecord struct {
+	Symbol    string `json:"symbol"`
+	Kind      string `json:"kind"`
+	PkgPath   string `json:"pkgPath"`
+	PkgName   string `json:"pkgName"`
+	File      string `json:"file"`
+	StartLine int    `json:"startLine"`
+	EndLine   int    `json:"endLine"`
+	Source    string `json:"source"`
+}
+
+// writeFlatJSON writes one JSON array with an object per definition,
+// ordered by package, file and position, for -flat-json.
+func writeFlatJSON(w io.Writer, results map[string]*printOutput, absRoot string) error {
+	var defs []*definition
+	for _, out := range results {
+		defs = append(defs, out.definitions...)
+	}
+	sort.SliceStable(defs, func(i, j int) bool {
+		if defs[i].pkgPath != defs[j].pkgPath {
+			return defs[i].pkgPath < defs[j].pkgPath
+		}
+		// Stubs have no file and go last.
+		if defs[i].file != defs[j].file {
+			return defs[j].file == "" || defs[i].file != "" && defs[i].file < defs[j].file
+		}
+		return defs[i].offset < defs[j].offset
+	})
+	records := make([]flatRecord, 0, len(defs))
+	for _, def := range defs {
+		records = append(records, flatRecord{
+			Symbol:    def.symbols[0],
+			Kind:      def.kind,
+			PkgPath:   def.pkgPath,
+			PkgName:   def.pkgName,
+			File:      displayPath(absRoot, def.file),
+			StartLine: def.startLine,
+			EndLine:   def.endLine,
+			Source:    def.source,
+		})
+	}
+	b, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// printSymbolTable prints one markdown table row per resolved symbol,
+// sorted by package and symbol, without any source.
+func printSymbolTable(w io.Writer, results map[string]*printOutput, absRoot string) {
+	type row struct{ symbol, kind, pkgPath, location string }
+	var rows []row
+	for _, out := range results {
+		for _, def := range out.definitions {
+			var loc string
+			if def.file != "" {
+				loc = fmt.Sprintf("%s:%d", displayPath(absRoot, def.file), def.startLine)
+			}
+			for _, sym := range def.symbols {
+				rows = append(rows, row{sym, def.kind, def.pkgPath, loc})
+			}
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].pkgPath != rows[j].pkgPath {
+			return rows[i].pkgPath < rows[j].pkgPath
+		}
+		return rows[i].symbol < rows[j].symbol
+	})
+
+	cell := strings.NewReplacer("|", "\\|").Replace
+	fmt.Fprintln(w, "| Symbol | Kind | Package | Location |")
+	fmt.Fprintln(w, "| --- | --- | --- | --- |")
+	for _, r := range rows {
+		fmt.Fprintf(w, "| `%s` | %s | `%s` | %s |\n", cell(r.symbol), r.kind, cell(r.pkgPath), cell(r.location))
+	}
+}
+
+// writeSymbolCSV writes one CSV record per resolved symbol, sorted by
+// package and symbol, with the definition's source as a last column when
+// withSource is set.
+func writeSymbolCSV(w io.Writer, results map[string]*printOutput, absRoot string, withSource bool) error {
+	type row struct {
+		symbol string
+		def    *definition
+	}
+	var rows []row
+	for _, out := range results {
+		for _, def := range out.definitions {
+			for _, sym := range def.symbols {
+				rows = append(rows, row{sym, def})
+			}
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].def.pkgPath != rows[j].def.pkgPath {
+			return rows[i].def.pkgPath < rows[j].def.pkgPath
+		}
+		return rows[i].symbol < rows[j].symbol
+	})
+
+	cw := csv.NewWriter(w)
+	header := []string{"symbol", "kind", "package", "file", "startLine", "endLine"}
+	if withSource {
+		header = append(header, "source")
+	}
+	cw.Write(header)
+	for _, r := range rows {
+		record := []string{r.symbol, r.def.kind, r.def.pkgPath, displayPath(absRoot, r.def.file), strconv.Itoa(r.def.startLine), strconv.Itoa(r.def.endLine)}
+		if withSource {
+			record = append(record, r.def.source)
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func printSections(w io.Writer, sections []*section, opts *options) {
+	if opts.format == "markdown" && opts.toc {
+		printTOC(w, sections)
+	}
+	format := opts.format
+	if format == "plain" && opts.plainStyle == "compact" {
+		format = "plain-compact"
+	}
+	if format == "plain" && opts.pretty {
+		format = "plain-pretty"
+	}
+	width := prettyWidth(w)
+	headerPrinted := make(map[string]bool)
+	contents := make(map[string][]byte)
+	for _, sec := range sections {
+		switch format {
+		case "go":
+			if len(sections) > 1 {
+				fmt.Fprintf(w, "// %s\n", sec.title)
+			}
+			w.Write(goFileSource(sec))
+			fmt.Fprintln(w)
+
+		case "patch":
+			fmt.Fprintln(w, "--- /dev/null")
+			fmt.Fprintf(w, "+++ b/%s\n", sec.title)
+			for _, def := range sec.definitions {
+				start, lines, ok := fileLines(def, contents, opts.encoding)
+				if !ok {
+					continue
+				}
+				fmt.Fprintf(w, "@@ -0,0 +%d,%d @@\n", start, len(lines))
+				for _, line := range lines {
+					fmt.Fprintf(w, "+%s\n", line)
+				}
+			}
+
+		case "org":
+			fmt.Fprintf(w, "* %s\n", sec.title)
+			fmt.Fprintln(w, "#+begin_src go")
+			fmt.Fprintf(w, "package %s\n\n", sec.pkgName)
+			printDefinitions(w, sec, headerPrinted, opts, orgEscape)
+			if sec.omitted > 0 {
+				fmt.Fprintf(w, "\n// ... and %d more\n", sec.omitted)
+			}
+			fmt.Fprintln(w, "#+end_src")
+			fmt.Fprintln(w)
+
+		case "markdown":
+			fmt.Fprintf(w, "### %s\n\n", sec.title)
+			if opts.groupMethodsUnderType {
+				for _, sub := range splitByReceiver(sec) {
+					fmt.Fprintf(w, "#### %s\n\n", sub.title)
+					if opts.mdPerDef {
+						printMarkdownPerDef(w, sub, "#####", headerPrinted, opts)
+						continue
+					}
+					fmt.Fprintln(w, "```go")
+					fmt.Fprintf(w, "package %s\n\n", sec.pkgName)
+					printDefinitions(w, sub, headerPrinted, opts, nil)
+					fmt.Fprintln(w, "```")
+					fmt.Fprintln(w)
+				}
+				if sec.omitted > 0 {
+					fmt.Fprintf(w, "... and %d more\n\n", sec.omitted)
+				}
+				continue
+			}
+			if opts.mdPerDef {
+				printMarkdownPerDef(w, sec, "####", headerPrinted, opts)
+				if sec.omitted > 0 {
+					fmt.Fprintf(w, "... and %d more\n\n", sec.omitted)
+				}
+				continue
+			}
+			fmt.Fprintln(w, "```go")
+			fmt.Fprintf(w, "package %s\n\n", sec.pkgName)
+			printDefinitions(w, sec, headerPrinted, opts, nil)
+			if sec.omitted > 0 {
+				fmt.Fprintf(w, "\n// ... and %d more\n", sec.omitted)
+			}
+			fmt.Fprintln(w, "```")
+			fmt.Fprintln(w)
+
+		case "plain-pretty":
+			printPrettySection(w, sec, width, headerPrinted, opts)
+
+		case "plain-compact":
+			fmt.Fprintf(w, "# %s\n\n", sec.title)
+			printDefinitions(w, sec, headerPrinted, opts, nil)
+			if sec.omitted > 0 {
+				fmt.Fprintf(w, "\n... and %d more\n", sec.omitted)
+			}
+			fmt.Fprintln(w)
+
+		default:
+			fmt.Fprintf(w, "%s: %s (package %s)\n", sec.label, sec.title, sec.pkgName)
+			if opts.divider != "" {
+				fmt.Fprintln(w, opts.divider)
+			}
+			fmt.Fprintf(w, "package %s\n\n", sec.pkgName)
+			printDefinitions(w, sec, headerPrinted, opts, nil)
+			if sec.omitted > 0 {
+				fmt.Fprintf(w, "\n... and %d more\n", sec.omitted)
+			}
+			if opts.divider != "" {
+				fmt.Fprintln(w, opts.divider)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// writePackageFiles writes the sections of each package to
+// DIR/<import path with slashes replaced by _>.<format extension>.
+func writePackageFiles(dir string, results map[string]*printOutput, group, absRoot string, opts *options) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	ext := map[string]string{"markdown": ".md", "markdown-table": ".md", "csv": ".csv", "ndjson": ".ndjson", "org": ".org", "patch": ".patch"}[opts.format]
+	if opts.flatJSON {
+		ext = ".json"
+	} else if ext == "" {
+		ext = ".txt"
+	}
+	pkgPaths := make([]string, 0, len(results))
+	for pkgPath, out := range results {
+		if len(out.definitions) > 0 {
+			pkgPaths = append(pkgPaths, pkgPath)
+		}
+	}
+	sort.Strings(pkgPaths)
+	for _, pkgPath := range pkgPaths {
+		name := strings.NewReplacer("/", "_", "\\", "_").Replace(pkgPath) + ext
+		path := filepath.Join(dir, name)
+		if opts.format == "go" {
+			// One file per package directory, as in a scratch module.
+			pkgDir := filepath.Join(dir, filepath.FromSlash(pkgPath))
+			if err := os.MkdirAll(pkgDir, 0o755); err != nil {
+				return err
+			}
+			path = filepath.Join(pkgDir, results[pkgPath].pkgName+".go")
+		}
+		var buf bytes.Buffer
+		render(&buf, map[string]*printOutput{pkgPath: results[pkgPath]}, group, absRoot, opts)
+		if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+			return err
+		}
+		log.Printf("wrote %s\n", path)
+	}
+	return nil
+}
+
+// printMarkdownPerDef prints every definition of sec under its own heading,
+// the canonical form of its first symbol, in a fence of its own.
+func printMarkdownPerDef(w io.Writer, sec *section, heading string, headerPrinted map[string]bool, opts *options) {
+	for _, def := range sec.definitions {
+		fmt.Fprintf(w, "%s `%s`\n\n", heading, canonicalSymbol(def.symbols[0]))
+		fmt.Fprintln(w, "```go")
+		printDefinitions(w, &section{definitions: []*definition{def}}, headerPrinted, opts, nil)
+		fmt.Fprintln(w, "```")
+		fmt.Fprintln(w)
+	}
+}
+
+// splitByReceiver splits a section into one subsection per type, holding
+// the type declaration and its methods in source order, sorted by type name,
+// followed by one for the remaining functions, vars and consts.
+func splitByReceiver(sec *section) []*section {
+	byType := make(map[string]*section)
+	other := &section{title: "Functions and values", pkgName: sec.pkgName}
+	for _, def := range sec.definitions {
+		typeName := def.receiver
+		if def.kind == "type" {
+			typeName = def.name
+		}
+		if typeName == "" {
+			other.definitions = append(other.definitions, def)
+			continue
+		}
+		sub, ok := byType[typeName]
+		if !ok {
+			sub = &section{title: typeName, pkgName: sec.pkgName}
+			byType[typeName] = sub
+		}
+		sub.definitions = append(sub.definitions, def)
+	}
+
+	names := make([]string, 0, len(byType))
+	for name := range byType {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var subs []*section
+	for _, name := range names {
+		sub := byType[name]
+		sort.SliceStable(sub.definitions, func(i, j int) bool {
+			di, dj := sub.definitions[i], sub.definitions[j]
+			if (di.kind == "type") != (dj.kind == "type") {
+				return di.kind == "type"
+			}
+			if di.file != dj.file {
+				return di.file < dj.file
+			}
+			return di.offset < dj.offset
+		})
+		subs = append(subs, sub)
+	}
+	if len(other.definitions) > 0 {
+		subs = append(subs, other)
+	}
+	return subs
+}
+
+func printDefinitions(w io.Writer, sec *section, headerPrinted map[string]bool, opts *options, escape func(string) string) {
+	if escape == nil {
+		escape = func(s string) string { return s }
+	}
+	for i, def := range sec.definitions {
+		if def.fileHeader != "" && !headerPrinted[def.file] {
+			headerPrinted[def.file] = true
+			fmt.Fprintf(w, "%s\n\n", escape(def.fileHeader))
+		}
+		if opts.annotate {
+			fmt.Fprintf(w, "// symbol: %s\n", strings.Join(def.symbols, ", "))
+		}
+		if def.blame != "" {
+			fmt.Fprintf(w, "// blame: %s\n", def.blame)
+		}
+		if opts.callGraph != nil {
+			if callers := opts.callGraph.callersOf(def.symbols); len(callers) > 0 {
+				fmt.Fprintf(w, "// called by: %s\n", strings.Join(callers, ", "))
+			}
+			if callees := opts.callGraph.calleesOf(def.symbols); len(callees) > 0 {
+				fmt.Fprintf(w, "// calls: %s\n", strings.Join(callees, ", "))
+			}
+		}
+		fmt.Fprintln(w, escape(def.source))
+		if i != len(sec.definitions)-1 {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// orgEscape prefixes a comma to lines that Org would otherwise read as a
+// headline or as the end of the source block (`*`, `#+end_src`), the same
+// way org-edit-src-code does.
+func orgEscape(src string) string {
+	lines := strings.Split(src, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimLeft(line, " \t")
+		if strings.HasPrefix(strings.TrimLeft(line, ","), "*") || strings.HasPrefix(strings.TrimLeft(trimmed, ","), "#+") {
+			lines[i] = line[:len(line)-len(trimmed)] + "," + trimmed
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func printTOC(w io.Writer, sections []*section) {
+	fmt.Fprintln(w, "## Contents")
+	fmt.Fprintln(w)
+	used := make(map[string]int)
+	for _, sec := range sections {
+		anchor := githubAnchor(sec.title)
+		if n := used[anchor]; n > 0 {
+			used[anchor]++
+			anchor = fmt.Sprintf("%s-%d", anchor, n)
+		} else {
+			used[anchor] = 1
+		}
+		fmt.Fprintf(w, "- [%s](#%s)\n", sec.title, anchor)
+		for _, def := range sec.definitions {
+			for _, sym := range def.symbols {
+				fmt.Fprintf(w, "  - `%s`\n", sym)
+			}
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+func githubAnchor(text string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.TrimSpace(text)) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_':
+			b.WriteRune(r)
+		case r == ' ':
+			b.WriteRune('-')
+		}
+	}
+	return b.String()
+}
+
+func displayPath(absRoot, filePath string) string {
+	rel, err := filepath.Rel(absRoot, filePath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return filePath
+	}
+	return filepath.ToSlash(rel)
+}
+
+// indexCache shares package indexes, keyed by package ID, between the
+// symbol groups of one run.
+type indexCache struct {
+	mu      sync.Mutex
+	indexes map[string]*packageIndex
+	built   int
+	reused  int
+}
+
+func newIndexCache() *indexCache {
+	return &indexCache{indexes: make(map[string]*packageIndex)}
+}
+
+func (c *indexCache) get(pkg *packages.Package, opts *options) *packageIndex {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if idx, ok := c.indexes[pkg.ID]; ok {
+		c.reused++
+		return idx
+	}
+	idx := buildPackageIndex(pkg, opts)
+	c.indexes[pkg.ID] = idx
+	c.built++
+	return idx
+}
+
+func buildPackageIndex(pkg *packages.Package, opts *options) *packageIndex {
+	idx := &packageIndex{
+		pkg:          pkg,
+		opts:         opts,
+		fset:         pkg.Fset,
+		fileContents: make(map[string][]byte),
+		files:        make(map[string]*ast.File),
+		funcDecls:    make(map[functionKey]*ast.FuncDecl),
+		typeSpecs:    make(map[string]*ast.GenDecl),
+		valueSpecs:   make(map[string]valueSpec),
+		changed:      make(map[string]map[int]bool),
+		cgo:          isCgoPackage(pkg),
+	}
+
+	for _, fAST := range pkg.Syntax {
+		idx.files[pkg.Fset.PositionFor(fAST.Package, false).Filename] = fAST
+		for _, d := range fAST.Decls {
+			switch decl := d.(type) {
+			case *ast.FuncDecl:
+				name := decl.Name.Name
+				var recvType string
+				var isPtr bool
+				if decl.Recv != nil && len(decl.Recv.List) > 0 {
+					recvExpr := decl.Recv.List[0].Type
+					rt, ptr := receiverTypeString(recvExpr)
+					recvType = rt
+					isPtr = ptr
+				}
+				// A package may declare any number of init functions.
+				if name == "init" && decl.Recv == nil {
+					idx.initFuncs = append(idx.initFuncs, decl)
+					continue
+				}
+				key := functionKey{
+					funcName:     name,
+					receiverType: recvType,
+					isPtr:        isPtr,
+				}
+				idx.funcDecls[key] = decl
+
+			case *ast.GenDecl:
+				if decl.Tok == token.TYPE {
+					for _, sp := range decl.Specs {
+						ts, ok := sp.(*ast.TypeSpec)
+						if !ok {
+							continue
+						}
+						typeName := ts.Name.Name
+						idx.typeSpecs[typeName] = decl
+					}
+				}
+				if decl.Tok == token.CONST || decl.Tok == token.VAR {
+					for _, sp := range decl.Specs {
+						vs, ok := sp.(*ast.ValueSpec)
+						if !ok {
+							continue
+						}
+						for i, name := range vs.Names {
+							if name.Name == "_" {
+								continue
+							}
+							idx.valueSpecs[name.Name] = valueSpec{decl: decl, spec: vs, index: i}
+						}
+					}
+				}
+			}
+		}
+	}
+	sort.SliceStable(idx.initFuncs, func(i, j int) bool {
+		pi, pj := idx.fset.Position(idx.initFuncs[i].Pos()), idx.fset.Position(idx.initFuncs[j].Pos())
+		if pi.Filename != pj.Filename {
+			return pi.Filename < pj.Filename
+		}
+		return pi.Offset < pj.Offset
+	})
+	return idx
+}
+
+// addInitFuncs prints every init function of the package, in file and
+// source order, each labelled with its location.
+func (idx *packageIndex) addInitFuncs(out *printOutput, sym string) {
+	if len(idx.initFuncs) == 0 {
+		out.notFound(sym, nil, idx.opts, fmt.Sprintf("No init functions found for symbol %q", sym))
+		return
+	}
+	for _, fn := range idx.initFuncs {
+		def, err := idx.newDeclDefinition(fn)
+		if err != nil {
+			log.Printf("failed to extract source of %q: %v\n", sym, err)
+			out.addUnresolved(sym, "extract_error", err)
+			return
+		}
+		def.source = fmt.Sprintf("// %s:%d\n%s", filepath.Base(def.file), def.startLine, def.source)
+		out.addDefinition(sym, def)
+	}
+}
+
+// resolveHinted resolves key like resolveKey, but only as the kind of
+// declaration named by a `func`, `method`, `type`, `var` or `const` hint.
+func (idx *packageIndex) resolveHinted(key functionKey, hint string) (*definition, bool, error) {
+	switch hint {
+	case "func", "method":
+		return idx.lookupFunc(key)
+	case "type":
+		return idx.lookupType(key)
+	case "var", "const":
+		def, ok, err := idx.lookupValue(key)
+		if ok && err == nil && def.kind != hint {
+			return nil, false, nil
+		}
+		return def, ok, err
+	}
+	return idx.resolveKey(key)
+}
+
+func (idx *packageIndex) resolveKey(key functionKey) (*definition, bool, error) {
+	defs, err := idx.resolveMatches(key, false)
+	if err != nil || len(defs) == 0 {
+		return nil, false, err
+	}
+	return defs[0], true, nil
+}
+
+// resolveMatches looks key up as a function or method, a type and a var or
+// const, in that order; -prefer=type swaps the first two. Unless all is set
+// it stops at the first match.
+func (idx *packageIndex) resolveMatches(key functionKey, all bool) ([]*definition, error) {
+	lookups := []func(functionKey) (*definition, bool, error){idx.lookupFunc, idx.lookupType, idx.lookupValue}
+	if idx.opts.prefer == "type" {
+		lookups[0], lookups[1] = lookups[1], lookups[0]
+	}
+	var defs []*definition
+	for _, lookup := range lookups {
+		def, ok, err := lookup(key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			defs = append(defs, def)
+			if !all {
+				break
+			}
+		}
+	}
+	return defs, nil
+}
+
+// declarationAt finds, among every declaration of the package named by
+// key, the first one spanning line. Unlike the index, which keeps one
+// declaration per name, it also sees names declared more than once, as in
+// packages loaded with -load-errors-ok.
+func (idx *packageIndex) declarationAt(key functionKey, line int) (*definition, bool, error) {
+	spans := func(n ast.Node) bool {
+		return idx.position(n.Pos()).Line <= line && line <= idx.position(n.End()).Line
+	}
+	for _, fAST := range idx.pkg.Syntax {
+		for _, d := range fAST.Decls {
+			if !spans(d) {
+				continue
+			}
+			switch decl := d.(type) {
+			case *ast.FuncDecl:
+				var recvType string
+				var isPtr bool
+				if decl.Recv != nil && len(decl.Recv.List) > 0 {
+					recvType, isPtr = receiverTypeString(decl.Recv.List[0].Type)
+				}
+				if (functionKey{funcName: decl.Name.Name, receiverType: recvType, isPtr: isPtr}) == key {
+					def, err := idx.newDeclDefinition(decl)
+					return def, true, err
+				}
+			case *ast.GenDecl:
+				if key.receiverType != "" {
+					continue
+				}
+				for _, sp := range decl.Specs {
+					switch spec := sp.(type) {
+					case *ast.TypeSpec:
+						if spec.Name.Name == key.funcName {
+							def, err := idx.newDefinition(decl, decl.Pos(), decl.End())
+							return def, true, err
+						}
+					case *ast.ValueSpec:
+						for i, name := range spec.Names {
+							if name.Name == key.funcName {
+								def, err := idx.newValueDefinition(valueSpec{decl: decl, spec: spec, index: i})
+								return def, true, err
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil, false, nil
+}
+
+func (idx *packageIndex) lookupFunc(key functionKey) (*definition, bool, error) {
+	decl, ok := idx.funcDecls[key]
+	if !ok {
+		return nil, false, nil
+	}
+	def, err := idx.newDeclDefinition(decl)
+	return def, true, err
+}
+
+func (idx *packageIndex) lookupType(key functionKey) (*definition, bool, error) {
+	genDecl, ok := idx.typeSpecs[key.funcName]
+	if !ok {
+		return nil, false, nil
+	}
+	def, err := idx.newDefinition(genDecl, genDecl.Pos(), genDecl.End())
+	return def, true, err
+}
+
+func (idx *packageIndex) lookupValue(key functionKey) (*definition, bool, error) {
+	vs, ok := idx.valueSpecs[key.funcName]
+	if !ok || key.receiverType != "" {
+		return nil, false, nil
+	}
+	def, err := idx.newValueDefinition(vs)
+	if err == nil && idx.opts.resolveEmbed {
+		// go:embed must sit in the doc comment of the var it applies to.
+		doc := vs.decl.Doc
+		if vs.decl.Lparen.IsValid() {
+			doc = vs.spec.Doc
+		}
+		var comments []string
+		if doc != nil {
+			for _, c := range doc.List {
+				comments = append(comments, c.Text)
+			}
+		}
+		if files := embeddedFiles(comments, filepath.Dir(def.file)); len(files) > 0 {
+			def.source += "\n// embeds: " + strings.Join(files, ", ")
+		}
+	}
+	return def, true, err
+}
+
+func (idx *packageIndex) newDeclDefinition(decl ast.Decl) (*definition, error) {
+	fn, ok := decl.(*ast.FuncDecl)
+	if !ok {
+		return idx.newDefinition(decl, decl.Pos(), decl.End())
+	}
+	end := decl.End()
+	if idx.opts.signatures || idx.opts.outline {
+		// FuncType spans the type parameters, params and results.
+		end = fn.Type.End()
+	}
+	def, err := idx.newDefinition(decl, decl.Pos(), end)
+	if err != nil {
+		return nil, err
+	}
+	if idx.opts.inlineTypes {
+		if lines := idx.inlineTypes(fn); len(lines) > 0 {
+			def.source = prependLines(lines, def.source)
+		}
+	}
+	switch {
+	case fn.Body == nil:
+		def.source += "\n// no Go body (assembly or external)"
+	case idx.opts.outline:
+		def.source += " { ... }"
+	}
+	return def, nil
+}
+
+func (idx *packageIndex) underlyingOf(typeName string) (string, bool) {
+	genDecl, ok := idx.typeSpecs[typeName]
+	if !ok || idx.pkg.Types == nil {
+		return "", false
+	}
+	for _, sp := range genDecl.Specs {
+		ts, ok := sp.(*ast.TypeSpec)
+		if !ok || ts.Name.Name != typeName {
+			continue
+		}
+		// Struct, interface and other literal types are their own underlying type.
+		switch ts.Type.(type) {
+		case *ast.Ident, *ast.SelectorExpr, *ast.IndexExpr, *ast.IndexListExpr, *ast.ParenExpr:
+		default:
+			return "", false
+		}
+	}
+	obj, ok := idx.pkg.Types.Scope().Lookup(typeName).(*types.TypeName)
+	if !ok {
+		return "", false
+	}
+	return types.TypeString(obj.Type().Underlying(), types.RelativeTo(idx.pkg.Types)), true
+}
+
+func (idx *packageIndex) methodsOf(typeName string) []*ast.FuncDecl {
+	var decls []*ast.FuncDecl
+	for key, decl := range idx.funcDecls {
+		if key.receiverType == typeName {
+			decls = append(decls, decl)
+		}
+	}
+	sort.Slice(decls, func(i, j int) bool {
+		return decls[i].Pos() < decls[j].Pos()
+	})
+	return decls
+}
+
+func (idx *packageIndex) addMethods(out *printOutput, sym, typeName string) {
+	for _, decl := range idx.methodsOf(typeName) {
+		def, err := idx.newDeclDefinition(decl)
+		if err != nil {
+			log.Printf("failed to extract method %s of %q: %v\n", decl.Name.Name, sym, err)
+			continue
+		}
+		out.addDefinition(sym, def)
+	}
+}
+
+func (idx *packageIndex) foldKey(key functionKey) (functionKey, bool) {
+	var matches []functionKey
+	for k := range idx.funcDecls {
+		if k.isPtr == key.isPtr && strings.EqualFold(k.funcName, key.funcName) && strings.EqualFold(k.receiverType, key.receiverType) {
+			matches = append(matches, k)
+		}
+	}
+	if key.receiverType == "" {
+		for name := range idx.typeSpecs {
+			if strings.EqualFold(name, key.funcName) {
+				matches = append(matches, functionKey{funcName: name})
+			}
+		}
+		for name := range idx.valueSpecs {
+			if strings.EqualFold(name, key.funcName) {
+				matches = append(matches, functionKey{funcName: name})
+			}
+		}
+	}
+	if len(matches) != 1 {
+		return functionKey{}, false
+	}
+	return matches[0], true
+}
+
+func (idx *packageIndex) declsInRange(file string, startLine, endLine int) ([]ast.Decl, error) {
+	for _, fAST := range idx.pkg.Syntax {
+		filename := idx.position(fAST.Package).Filename
+		if !matchesFile(filename, file) {
+			continue
+		}
+		var decls []ast.Decl
+		for _, d := range fAST.Decls {
+			start := idx.position(d.Pos()).Line
+			end := idx.position(d.End()).Line
+			if start <= endLine && end >= startLine {
+				decls = append(decls, d)
+			}
+		}
+		return decls, nil
+	}
+	return nil, fmt.Errorf("file %q not found in package %s", file, idx.pkg.PkgPath)
+}
+
+func matchesFile(filename, file string) bool {
+	filename = filepath.ToSlash(filename)
+	file = filepath.ToSlash(file)
+	return filename == file || strings.HasSuffix(filename, "/"+file)
+}
+
+// addDefinition records that sym resolved to def. Whatever requested it, a
+// declaration is printed at most once per package: a definition lying
+// within one already added (the same node, or a const of a group printed
+// whole) only adds its symbol, and one enclosing earlier definitions takes
+// their place and symbols.
+func (out *printOutput) addDefinition(sym string, def *definition) {
+	if out.keepAll {
+		def.symbols = []string{sym}
+		out.definitions = append(out.definitions, def)
+		return
+	}
+	for _, d := range out.definitions {
+		if d.srcFile == def.srcFile && d.offset <= def.offset && def.endOffset <= d.endOffset {
+			if !d.hasSymbol(sym) {
+				d.symbols = append(d.symbols, sym)
+			}
+			return
+		}
+	}
+	def.symbols = []string{sym}
+
+	insert := -1
+	var kept []*definition
+	for _, d := range out.definitions {
+		if d.srcFile == def.srcFile && def.offset <= d.offset && d.endOffset <= def.endOffset {
+			for _, s := range d.symbols {
+				if !def.hasSymbol(s) {
+					def.symbols = append(def.symbols, s)
+				}
+			}
+			if insert < 0 {
+				insert = len(kept)
+			}
+			continue
+		}
+		kept = append(kept, d)
+	}
+	if insert < 0 {
+		out.definitions = append(kept, def)
+		return
+	}
+	out.definitions = append(kept[:insert], append([]*definition{def}, kept[insert:]...)...)
+}
+
+func (def *definition) hasSymbol(sym string) bool {
+	for _, s := range def.symbols {
+		if s == sym {
+			return true
+		}
+	}
+	return false
+}
+
+func (out *printOutput) addUnresolved(sym, reason string, err error) {
+	out.unresolved = append(out.unresolved, newUnresolved(sym, reason, err))
+}
+
+// notFound records sym, which matched no declaration, and logs why unless
+// -on-not-found=stub prints a placeholder for it instead.
+func (out *printOutput) notFound(sym string, err error, opts *options, why string) {
+	if opts.onNotFound != "stub" {
+		log.Println(why)
+	}
+	out.addUnresolved(sym, "not_found", err)
+}
+
+// errNotFound is wrapped by the error checkNotFound returns.
+var errNotFound = errors.New("no declaration found")
+
+// checkNotFound returns an error listing the symbols no declaration was
+// found for, by package, if there are any and -on-not-found=error.
+func checkNotFound(results map[string]*printOutput, opts *options) error {
+	if opts.onNotFound != "error" {
+		return nil
+	}
+	pkgPaths := make([]string, 0, len(results))
+	for p := range results {
+		pkgPaths = append(pkgPaths, p)
+	}
+	sort.Strings(pkgPaths)
+	var missing []string
+	for _, p := range pkgPaths {
+		for _, u := range results[p].unresolved {
+			if u.Reason == "not_found" {
+				missing = append(missing, u.Symbol)
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w for:\n  %s", errNotFound, strings.Join(missing, "\n  "))
+}
+
+// withStubs returns results with a `// TODO: symbol not found` placeholder
+// definition for every symbol no declaration was found for, for
+// -on-not-found=stub. Each stub goes where the symbol's definition would
+// be in input order: after the definitions of the closest earlier input
+// symbol that has any.
+func withStubs(results map[string]*printOutput) map[string]*printOutput {
+	stubbed := make(map[string]*printOutput, len(results))
+	for p, out := range results {
+		cp := *out
+		cp.definitions = append([]*definition(nil), out.definitions...)
+		order := make(map[string]int, len(out.symbols))
+		for i, sym := range out.symbols {
+			order[sym] = i
+		}
+		for _, u := range out.unresolved {
+			if u.Reason != "not_found" {
+				continue
+			}
+			stub := &definition{
+				symbols: []string{u.Symbol},
+				kind:    "stub",
+				pkgName: out.pkgName,
+				pkgPath: out.pkgPath,
+				source:  fmt.Sprintf("// TODO: %s not found", u.Symbol),
+			}
+			at := len(cp.definitions)
+			if k, ok := order[u.Symbol]; ok {
+				at = stubPosition(cp.definitions, order, k)
+			}
+			cp.definitions = append(cp.definitions[:at], append([]*definition{stub}, cp.definitions[at:]...)...)
+		}
+		stubbed[p] = &cp
+	}
+	return stubbed
+}
+
+// stubPosition returns the index in defs after the last definition of the
+// closest input symbol before the k-th one, or 0 if no earlier symbol has
+// a definition.
+func stubPosition(defs []*definition, order map[string]int, k int) int {
+	at, closest := 0, -1
+	for i, def := range defs {
+		for _, sym := range def.symbols {
+			if j, ok := order[sym]; ok && j < k && j >= closest {
+				at, closest = i+1, j
+			}
+		}
+	}
+	return at
+}
+
+func newUnresolved(sym, reason string, err error) unresolvedSymbol {
+	u := unresolvedSymbol{Symbol: sym, Reason: reason}
+	if err != nil {
+		u.Error = err.Error()
+	}
+	return u
+}
+
+func writeUnresolved(path string, unresolved []unresolvedSymbol, results map[string]*printOutput) error {
+	pkgPaths := make([]string, 0, len(results))
+	for p := range results {
+		pkgPaths = append(pkgPaths, p)
+	}
+	sort.Strings(pkgPaths)
+
+	all := append([]unresolvedSymbol{}, unresolved...)
+	for _, p := range pkgPaths {
+		all = append(all, results[p].unresolved...)
+	}
+	b, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+type runStats struct {
+	InputSymbols  int            `json:"inputSymbols"`
+	UniqueSymbols int            `json:"uniqueSymbols"`
+	Resolved      int            `json:"resolved"`
+	Definitions   int            `json:"definitions"`
+	Failed        int            `json:"failed"`
+	Filtered      int            `json:"filtered"`
+	Packages      []string       `json:"packages"`
+	PerPackage    map[string]int `json:"perPackage"`
+}
+
+func writeStats(path string, inputSymbols, uniqueSymbols int, results map[string]*printOutput, unresolved []unresolvedSymbol, filtered int) error {
+	stats := runStats{
+		InputSymbols:  inputSymbols,
+		UniqueSymbols: uniqueSymbols,
+		Failed:        len(unresolved),
+		Filtered:      filtered,
+		Packages:      []string{},
+		PerPackage:    make(map[string]int),
+	}
+	resolved := make(map[string]bool)
+	for p, out := range results {
+		stats.Failed += len(out.unresolved)
+		if len(out.definitions) == 0 {
+			continue
+		}
+		stats.Packages = append(stats.Packages, p)
+		stats.PerPackage[p] = len(out.definitions)
+		stats.Definitions += len(out.definitions)
+		for _, def := range out.definitions {
+			for _, sym := range def.symbols {
+				resolved[sym] = true
+			}
+		}
+	}
+	sort.Strings(stats.Packages)
+	stats.Resolved = len(resolved)
+
+	b, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+type indexEntry struct {
+	File      string `json:"file"`
+	StartLine int    `json:"startLine"`
+	StartCol  int    `json:"startCol"`
+	EndLine   int    `json:"endLine"`
+	EndCol    int    `json:"endCol"`
+	Kind      string `json:"kind"`
+}
+
+// writeIndex writes, for -index-out, a JSON object mapping every resolved
+// symbol to the position of its definition.
+func writeIndex(path string, results map[string]*printOutput) error {
+	index := make(map[string]indexEntry)
+	for _, out := range results {
+		for _, def := range out.definitions {
+			for _, sym := range def.symbols {
+				index[sym] = indexEntry{
+					File:      def.file,
+					StartLine: def.startLine,
+					StartCol:  def.startCol,
+					EndLine:   def.endLine,
+					EndCol:    def.endCol,
+					Kind:      def.kind,
+				}
+			}
+		}
+	}
+	b, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+func (idx *packageIndex) newValueDefinition(vs valueSpec) (*definition, error) {
+	if idx.opts.funcBody && vs.index < len(vs.spec.Values) {
+		if lit, ok := vs.spec.Values[vs.index].(*ast.FuncLit); ok {
+			def, err := idx.newDefinition(lit, lit.Pos(), lit.End())
+			if err != nil {
+				return nil, err
+			}
+			def.kind = vs.decl.Tok.String()
+			def.name = vs.spec.Names[vs.index].Name
+			return def, nil
+		}
+	}
+	if !vs.decl.Lparen.IsValid() {
+		return idx.newDefinition(vs.decl, vs.decl.Pos(), vs.decl.End())
+	}
+	if idx.opts.contextDecl {
+		return idx.newContextDefinition(vs)
+	}
+	def, err := idx.newDefinition(vs.spec, vs.spec.Pos(), vs.spec.End())
+	if err != nil {
+		return nil, err
+	}
+	def.source = vs.decl.Tok.String() + " " + def.source
+	def.kind = vs.decl.Tok.String()
+	return def, nil
+}
+
+// newContextDefinition prints the whole var or const group of vs, for
+// -context-decl, marking the line that declares the requested name.
+func (idx *packageIndex) newContextDefinition(vs valueSpec) (*definition, error) {
+	def, err := idx.newDefinition(vs.decl, vs.decl.Pos(), vs.decl.End())
+	if err != nil {
+		return nil, err
+	}
+	// Count from the closing parenthesis: options may prepend lines.
+	name := vs.spec.Names[vs.index]
+	fromEnd := idx.fset.Position(vs.decl.End()).Line - idx.fset.Position(name.Pos()).Line
+	lines := strings.Split(def.source, "\n")
+	if i := len(lines) - 1 - fromEnd; i >= 0 && i < len(lines) {
+		if idx.commentAfter(name.Pos()) {
+			// A line comment would swallow the marker: put it above.
+			indent := lines[i][:len(lines[i])-len(strings.TrimLeft(lines[i], " \t"))]
+			lines = append(lines[:i], append([]string{indent + "// requested:"}, lines[i:]...)...)
+		} else {
+			lines[i] += " // <-- requested"
+		}
+	}
+	def.source = strings.Join(lines, "\n")
+	def.name = vs.spec.Names[vs.index].Name
+	return def, nil
+}
+
+// commentAfter reports whether a comment follows pos on its line.
+func (idx *packageIndex) commentAfter(pos token.Pos) bool {
+	fAST, ok := idx.files[idx.fset.PositionFor(pos, false).Filename]
+	if !ok {
+		return false
+	}
+	line := idx.fset.PositionFor(pos, false).Line
+	for _, cg := range fAST.Comments {
+		if cg.Pos() > pos && idx.fset.PositionFor(cg.Pos(), false).Line == line {
+			return true
+		}
+	}
+	return false
+}
+
+func (idx *packageIndex) lineCommentEnd(endPos token.Pos) token.Pos {
+	pos := idx.fset.PositionFor(endPos, false)
+	fAST, ok := idx.files[pos.Filename]
+	if !ok {
+		return endPos
+	}
+	for _, cg := range fAST.Comments {
+		if cg.End() <= endPos {
+			continue
+		}
+		for _, c := range cg.List {
+			if idx.fset.PositionFor(c.Pos(), false).Line != pos.Line {
+				return endPos
+			}
+			endPos = c.End()
+		}
+		return endPos
+	}
+	return endPos
+}
+
+// directives returns the //go: lines of the comments between the previous
+// declaration (or the package clause) and pos.
+func (idx *packageIndex) directives(pos token.Pos) []string {
+	fAST, ok := idx.files[idx.fset.PositionFor(pos, false).Filename]
+	if !ok {
+		return nil
+	}
+	prevEnd := fAST.Name.End()
+	for _, d := range fAST.Decls {
+		if d.End() <= pos && d.End() > prevEnd {
+			prevEnd = d.End()
+		}
+	}
+	var lines []string
+	for _, cg := range fAST.Comments {
+		if cg.End() > pos {
+			break
+		}
+		if cg.Pos() < prevEnd {
+			continue
+		}
+		for _, c := range cg.List {
+			if strings.HasPrefix(c.Text, "//go:") {
+				lines = append(lines, c.Text)
+			}
+		}
+	}
+	return lines
+}
+
+func (idx *packageIndex) sectionComment(pos token.Pos) *ast.CommentGroup {
+	fAST, ok := idx.files[idx.fset.PositionFor(pos, false).Filename]
+	if !ok {
+		return nil
+	}
+
+	docs := make(map[*ast.CommentGroup]bool)
+	for _, d := range fAST.Decls {
+		switch decl := d.(type) {
+		case *ast.FuncDecl:
+			docs[decl.Doc] = true
+		case *ast.GenDecl:
+			docs[decl.Doc] = true
+			for _, sp := range decl.Specs {
+				switch spec := sp.(type) {
+				case *ast.TypeSpec:
+					docs[spec.Doc] = true
+				case *ast.ValueSpec:
+					docs[spec.Doc] = true
+				}
+			}
+		}
+	}
+
+	var banner *ast.CommentGroup
+	for _, cg := range fAST.Comments {
+		if cg.End() > pos {
+			break
+		}
+		if cg.Pos() < fAST.Name.End() || docs[cg] || insideDecl(fAST, cg) || !idx.startsLine(cg.Pos()) {
+			continue
+		}
+		banner = cg
+	}
+	return banner
+}
+
+func insideDecl(fAST *ast.File, node ast.Node) bool {
+	for _, d := range fAST.Decls {
+		if d.Pos() <= node.Pos() && node.End() <= d.End() {
+			return true
+		}
+	}
+	return false
+}
+
+func (idx *packageIndex) startsLine(pos token.Pos) bool {
+	p := idx.fset.PositionFor(pos, false)
+	content, err := idx.getFileContent(p.Filename)
+	if err != nil || p.Offset > len(content) {
+		return false
+	}
+	for i := p.Offset - 1; i >= 0 && content[i] != '\n'; i-- {
+		if content[i] != ' ' && content[i] != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+func (idx *packageIndex) fileHeader(pos token.Pos) string {
+	fAST, ok := idx.files[idx.fset.PositionFor(pos, false).Filename]
+	if !ok {
+		return ""
+	}
+	var parts []string
+	for _, cg := range fAST.Comments {
+		if cg.End() > fAST.Package {
+			break
+		}
+		if idx.opts.excludeLicense && cg != fAST.Doc && idx.looksLikeLicense(cg.Text()) {
+			continue
+		}
+		text, err := idx.extractNodeSource(cg, cg.Pos(), cg.End())
+		if err != nil {
+			return ""
+		}
+		parts = append(parts, text)
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+func (idx *packageIndex) looksLikeLicense(text string) bool {
+	lower := strings.ToLower(text)
+	for _, kw := range strings.Split(idx.opts.licenseKeywords, ",") {
+		if kw = strings.TrimSpace(kw); kw != "" && strings.Contains(lower, strings.ToLower(kw)) {
+			return true
+		}
 	}
-	rootDir := args[0]
+	return false
+}
 
-	symbols, err := readSymbolsFromStdin()
+// normalizeReceiver drops the receiver name from a method's source, turning
+// `func (s *Server) Do()` into `func (*Server) Do()`. Sources that include
+// the body, which may use the name, are returned unchanged.
+func (idx *packageIndex) normalizeReceiver(fn *ast.FuncDecl, startPos, endPos token.Pos, src string) (string, error) {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 || len(fn.Recv.List[0].Names) == 0 {
+		return src, nil
+	}
+	if fn.Body != nil && endPos > fn.Body.Lbrace {
+		return src, nil
+	}
+	recvType, err := idx.extractNodeSource(fn.Recv.List[0].Type, fn.Recv.List[0].Type.Pos(), fn.Recv.List[0].Type.End())
 	if err != nil {
-		log.Fatalf("failed to read symbols: %v", err)
+		return "", err
 	}
-	if len(symbols) == 0 {
-		log.Println("No symbols found in input")
-		return
+	from := int(fn.Recv.Pos() - startPos)
+	to := int(fn.Recv.End() - startPos)
+	if from < 0 || to > len(src) {
+		return src, nil
 	}
+	return src[:from] + "(" + recvType + ")" + src[to:], nil
+}
 
-	absRoot, err := filepath.Abs(rootDir)
+func (idx *packageIndex) newDefinition(node ast.Node, startPos, endPos token.Pos) (*definition, error) {
+	if idx.opts.withLineComments {
+		endPos = idx.lineCommentEnd(endPos)
+	}
+	src, err := idx.extractNodeSource(node, startPos, endPos)
 	if err != nil {
-		log.Fatalf("failed to get absolute module root path: %v", err)
+		return nil, err
 	}
-
-	symbolsByPkg := make(map[string][]string)
-	printed := make(map[string]bool)
-
-	for _, sym := range symbols {
-		if printed[sym] {
-			continue
+	if fn, ok := node.(*ast.FuncDecl); ok && idx.opts.normalizeReceiver {
+		if src, err = idx.normalizeReceiver(fn, startPos, endPos, src); err != nil {
+			return nil, err
 		}
-		printed[sym] = true
-
-		pkgPath, _, _, _, parseErr := parseSymbol(sym)
-		if parseErr != nil {
-			log.Printf("skip symbol %q: %v\n", sym, parseErr)
-			continue
+	}
+	if idx.opts.highlightDiff != "" {
+		p := idx.fset.PositionFor(startPos, false)
+		src = idx.highlightChanged(src, p.Filename, p.Line)
+	}
+	if idx.opts.withDirectives {
+		if lines := idx.directives(startPos); len(lines) > 0 {
+			src = strings.Join(lines, "\n") + "\n" + src
 		}
-		symbolsByPkg[pkgPath] = append(symbolsByPkg[pkgPath], sym)
 	}
-
-	results := make(map[string]*printOutput)
-	for pkgPath, syms := range symbolsByPkg {
-		pkgs, err := loadPackages(absRoot, pkgPath)
-		if err != nil {
-			log.Printf("failed to load package %q: %v\n", pkgPath, err)
-			continue
+	if idx.opts.withSection {
+		if cg := idx.sectionComment(startPos); cg != nil {
+			banner, err := idx.extractNodeSource(cg, cg.Pos(), cg.End())
+			if err != nil {
+				return nil, err
+			}
+			src = banner + "\n\n" + src
 		}
-		pkg := pkgs[0]
+	}
+	if idx.opts.wrap > 0 {
+		src = wrapComments(src, idx.opts.wrap)
+	}
+	var header string
+	if idx.opts.includeFileHeader {
+		header = idx.fileHeader(startPos)
+	}
+	var receiver string
+	if fn, ok := node.(*ast.FuncDecl); ok && fn.Recv != nil && len(fn.Recv.List) > 0 {
+		receiver, _ = receiverTypeString(fn.Recv.List[0].Type)
+	}
+	start := idx.position(startPos)
+	end := idx.position(endPos)
+	var imports map[string]string
+	if idx.opts.format == "go" {
+		imports = idx.packageRefs(node)
+	}
+	srcFile, offset, endOffset := idx.sourceRange(startPos, endPos)
+	return &definition{
+		kind:       declKind(node),
+		name:       declName(node),
+		receiver:   receiver,
+		pkgName:    idx.pkg.Name,
+		pkgPath:    idx.pkg.PkgPath,
+		file:       start.Filename,
+		srcFile:    srcFile,
+		startLine:  start.Line,
+		startCol:   start.Column,
+		endLine:    end.Line,
+		endCol:     end.Column,
+		offset:     offset,
+		endOffset:  endOffset,
+		source:     src,
+		fileHeader: header,
+		imports:    imports,
+	}, nil
+}
 
-		idx := buildPackageIndex(pkg)
+// fileLines returns the whole lines of the parsed file def was cut from,
+// and the number of the first, without anything options added to the
+// source. Stubs and definitions whose file cannot be read yield !ok.
+func fileLines(def *definition, contents map[string][]byte, encoding string) (int, []string, bool) {
+	if def.srcFile == "" {
+		return 0, nil, false
+	}
+	content, ok := contents[def.srcFile]
+	if !ok {
+		content, _ = os.ReadFile(def.srcFile)
+		contents[def.srcFile] = content
+	}
+	if def.endOffset > len(content) || def.offset > def.endOffset {
+		return 0, nil, false
+	}
+	start := bytes.LastIndexByte(content[:def.offset], '\n') + 1
+	end := def.endOffset
+	if i := bytes.IndexByte(content[end:], '\n'); i >= 0 {
+		end += i
+	} else {
+		end = len(content)
+	}
+	line := bytes.Count(content[:start], []byte("\n")) + 1
+	return line, strings.Split(decodeSource(content[start:end], encoding), "\n"), true
+}
 
-		for _, sym := range syms {
-			pkgPath, receiverType, isPtr, funcOrTypeName, err := parseSymbol(sym)
-			if err != nil {
-				log.Printf("skip symbol %q: %v\n", sym, err)
+// mergeConsecutive joins each definition with the one before it when, in
+// the same file, only blank space and comments separate the two, keeping
+// whatever lies between them.
+func mergeConsecutive(results map[string]*printOutput, encoding string) {
+	contents := make(map[string][]byte)
+	for _, out := range results {
+		var merged []*definition
+		for _, def := range out.definitions {
+			if len(merged) == 0 {
+				merged = append(merged, def)
 				continue
 			}
-
-			if _, ok := results[pkgPath]; !ok {
-				results[pkgPath] = &printOutput{
-					pkgName:     pkg.Name,
-					pkgPath:     pkgPath,
-					definitions: []string{},
-				}
+			prev := merged[len(merged)-1]
+			if prev.srcFile != def.srcFile || prev.endOffset > def.offset {
+				merged = append(merged, def)
+				continue
 			}
-
-			fnKey := functionKey{
-				funcName:     funcOrTypeName,
-				receiverType: receiverType,
-				isPtr:        isPtr,
+			content, ok := contents[def.srcFile]
+			if !ok {
+				content, _ = os.ReadFile(def.srcFile)
+				contents[def.srcFile] = content
 			}
-			if decl, ok := idx.funcDecls[fnKey]; ok {
-				src, err := idx.extractNodeSource(decl, decl.Pos(), decl.End())
-				if err != nil {
-					log.Printf("failed to extract source of %q: %v\n", sym, err)
-					continue
-				}
-				results[pkgPath].definitions = append(results[pkgPath].definitions, src)
+			if def.offset > len(content) {
+				merged = append(merged, def)
 				continue
 			}
-
-			if genDecl, ok := idx.typeSpecs[funcOrTypeName]; ok {
-				src, err := idx.extractNodeSource(genDecl, genDecl.Pos(), genDecl.End())
-				if err != nil {
-					log.Printf("failed to extract type source of %q: %v\n", sym, err)
-					continue
-				}
-				results[pkgPath].definitions = append(results[pkgPath].definitions, src)
+			between := decodeSource(content[prev.endOffset:def.offset], encoding)
+			if !onlySpaceAndComments(between) {
+				merged = append(merged, def)
 				continue
 			}
-
-			log.Printf("No matching function or type declaration found for symbol %q\n", sym)
+			prev.source += between + def.source
+			prev.endLine = def.endLine
+			prev.endCol = def.endCol
+			prev.endOffset = def.endOffset
+			for _, sym := range def.symbols {
+				if !prev.hasSymbol(sym) {
+					prev.symbols = append(prev.symbols, sym)
+				}
+			}
 		}
+		out.definitions = merged
 	}
+}
 
-	pkgPaths := make([]string, 0, len(results))
-	for p := range results {
-		pkgPaths = append(pkgPaths, p)
-	}
-	sort.Strings(pkgPaths)
-
-	for _, pkgKey := range pkgPaths {
-		out := results[pkgKey]
-		switch *formatFlag {
-		case "markdown":
-			fmt.Printf("### %s\n\n", out.pkgPath)
-			fmt.Println("```go")
-			fmt.Printf("package %s\n\n", out.pkgName)
-			for i, snippet := range out.definitions {
-				fmt.Println(snippet)
-				if i != len(out.definitions)-1 {
-					fmt.Println()
-				}
+func onlySpaceAndComments(s string) bool {
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		switch {
+		case s == "":
+			return true
+		case strings.HasPrefix(s, "//"):
+			i := strings.IndexByte(s, '\n')
+			if i < 0 {
+				return true
 			}
-			fmt.Println("```")
-			fmt.Println()
-
-		default:
-			fmt.Printf("Package: %s (package %s)\n", out.pkgPath, out.pkgName)
-			fmt.Println("--------------------------------------------------")
-			fmt.Printf("package %s\n\n", out.pkgName)
-			for i, snippet := range out.definitions {
-				fmt.Println(snippet)
-				if i != len(out.definitions)-1 {
-					fmt.Println()
-				}
+			s = s[i:]
+		case strings.HasPrefix(s, "/*"):
+			i := strings.Index(s, "*/")
+			if i < 0 {
+				return false
 			}
-			fmt.Println("--------------------------------------------------")
-			fmt.Println()
+			s = s[i+2:]
+		default:
+			return false
 		}
 	}
 }
 
-func buildPackageIndex(pkg *packages.Package) *packageIndex {
-	idx := &packageIndex{
-		pkg:          pkg,
-		fset:         pkg.Fset,
-		fileContents: make(map[string][]byte),
-		funcDecls:    make(map[functionKey]*ast.FuncDecl),
-		typeSpecs:    make(map[string]*ast.GenDecl),
+// declName is the name definitions are sorted by with -sort-defs=name;
+// methods sort as Type.Method, next to their type.
+func declName(node ast.Node) string {
+	switch n := node.(type) {
+	case *ast.FuncDecl:
+		if n.Recv != nil && len(n.Recv.List) > 0 {
+			recv, _ := receiverTypeString(n.Recv.List[0].Type)
+			return recv + "." + n.Name.Name
+		}
+		return n.Name.Name
+	case *ast.GenDecl:
+		if len(n.Specs) > 0 {
+			return declName(n.Specs[0])
+		}
+	case *ast.TypeSpec:
+		return n.Name.Name
+	case *ast.ValueSpec:
+		if len(n.Names) > 0 {
+			return n.Names[0].Name
+		}
 	}
+	return ""
+}
 
-	for _, fAST := range pkg.Syntax {
-		for _, d := range fAST.Decls {
-			switch decl := d.(type) {
-			case *ast.FuncDecl:
-				name := decl.Name.Name
-				var recvType string
-				var isPtr bool
-				if decl.Recv != nil && len(decl.Recv.List) > 0 {
-					recvExpr := decl.Recv.List[0].Type
-					rt, ptr := receiverTypeString(recvExpr)
-					recvType = rt
-					isPtr = ptr
-				}
-				key := functionKey{
-					funcName:     name,
-					receiverType: recvType,
-					isPtr:        isPtr,
-				}
-				idx.funcDecls[key] = decl
+// limitDefinitions keeps the first n definitions of each package in the
+// order they were resolved, which is input order, for
+// -definitions-per-package-limit. It runs before sortDefinitions, so the
+// order chosen by -sort-defs only arranges what is kept.
+func limitDefinitions(results map[string]*printOutput, n int) {
+	for _, out := range results {
+		if len(out.definitions) > n {
+			out.omitted = len(out.definitions) - n
+			out.definitions = out.definitions[:n]
+		}
+	}
+}
 
-			case *ast.GenDecl:
-				if decl.Tok == token.TYPE {
-					for _, sp := range decl.Specs {
-						ts, ok := sp.(*ast.TypeSpec)
-						if !ok {
-							continue
-						}
-						typeName := ts.Name.Name
-						idx.typeSpecs[typeName] = decl
-					}
-				}
+func sortDefinitions(results map[string]*printOutput, order string) {
+	if order == "input" {
+		return
+	}
+	for _, out := range results {
+		defs := out.definitions
+		sort.SliceStable(defs, func(i, j int) bool {
+			if order == "name" && defs[i].name != defs[j].name {
+				return defs[i].name < defs[j].name
 			}
+			if defs[i].file != defs[j].file {
+				return defs[i].file < defs[j].file
+			}
+			return defs[i].offset < defs[j].offset
+		})
+	}
+}
+
+func declKind(node ast.Node) string {
+	switch n := node.(type) {
+	case *ast.FuncDecl:
+		if n.Recv != nil {
+			return "method"
 		}
+		return "func"
+	case *ast.GenDecl:
+		return n.Tok.String()
+	default:
+		return ""
 	}
-	return idx
 }
 
 func (idx *packageIndex) extractNodeSource(node ast.Node, startPos, endPos token.Pos) (string, error) {
-	filePos := idx.fset.Position(startPos)
-	fileEnd := idx.fset.Position(endPos)
+	// Unadjusted positions name the file the AST was parsed from, even when
+	// it carries //line directives pointing elsewhere.
+	filePos := idx.fset.PositionFor(startPos, false)
+	fileEnd := idx.fset.PositionFor(endPos, false)
 	filePath := filePos.Filename
 
+	// In a cgo package those files are cgo's rewritten output; print the
+	// original source instead.
+	if idx.cgo {
+		if file, start, end, ok := idx.cgoRange(startPos, endPos); ok {
+			content, err := idx.getFileContent(file)
+			if err != nil {
+				return "", err
+			}
+			return decodeSource(content[start:end], idx.opts.encoding), nil
+		}
+		if !strings.HasSuffix(filePath, ".go") {
+			log.Printf("warning: %s: cannot map %s back to its cgo source; printing cgo output\n", idx.pkg.PkgPath, idx.fset.Position(startPos))
+		}
+	}
+
 	content, err := idx.getFileContent(filePath)
 	if err != nil {
 		return "", err
 	}
+	if tf := idx.fset.File(startPos); tf != nil && tf.Size() != len(content) {
+		return "", fmt.Errorf("file '%s' changed since it was parsed: size %d, parsed %d", filePath, len(content), tf.Size())
+	}
 
 	startOffset := filePos.Offset
 	endOffset := fileEnd.Offset
 	if startOffset >= len(content) || endOffset > len(content) {
 		return "", fmt.Errorf("invalid positions: start=%d end=%d len=%d", startOffset, endOffset, len(content))
 	}
-	return string(content[startOffset:endOffset]), nil
+	return decodeSource(content[startOffset:endOffset], idx.opts.encoding), nil
+}
+
+// sourceRange is the file and byte offsets source between startPos and
+// endPos is cut from: the parsed file, or for cgo the original .go file.
+func (idx *packageIndex) sourceRange(startPos, endPos token.Pos) (file string, start, end int) {
+	if idx.cgo {
+		if file, start, end, ok := idx.cgoRange(startPos, endPos); ok {
+			return file, start, end
+		}
+	}
+	s, e := idx.fset.PositionFor(startPos, false), idx.fset.PositionFor(endPos, false)
+	return s.Filename, s.Offset, e.Offset
+}
+
+// position is the location of pos to report, which honours //line
+// directives unless the file they name does not exist, as with generated
+// code whose grammar or template was not checked in; then it is the
+// location in the file that was parsed.
+func (idx *packageIndex) position(pos token.Pos) token.Position {
+	p := idx.fset.Position(pos)
+	if _, err := idx.getFileContent(p.Filename); err != nil {
+		return idx.fset.PositionFor(pos, false)
+	}
+	return p
 }
 
 func (idx *packageIndex) getFileContent(filePath string) ([]byte, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
 	if b, ok := idx.fileContents[filePath]; ok {
 		return b, nil
 	}
@@ -247,16 +2853,20 @@ func (idx *packageIndex) getFileContent(filePath string) ([]byte, error) {
 	return b, nil
 }
 
+// receiverTypeString returns the base type name of a method receiver and
+// whether it is a pointer, dropping type parameters and parentheses. Methods
+// can only be declared on types of their own package, so a package
+// qualifier, which only appears in code that does not type-check, is
+// dropped as well: `func (p *other.T) M()` is indexed as `(*T).M`.
 func receiverTypeString(expr ast.Expr) (string, bool) {
 	switch e := expr.(type) {
 	case *ast.StarExpr:
-		if id, ok := e.X.(*ast.Ident); ok {
-			return id.Name, true
-		}
-		if sel, ok := e.X.(*ast.SelectorExpr); ok {
-			return sel.Sel.Name, true
-		}
-		return "", true
+		name, _ := receiverTypeString(e.X)
+		return name, true
+	case *ast.IndexExpr:
+		return receiverTypeString(e.X)
+	case *ast.IndexListExpr:
+		return receiverTypeString(e.X)
 	case *ast.Ident:
 		return e.Name, false
 	case *ast.SelectorExpr:
@@ -268,28 +2878,92 @@ func receiverTypeString(expr ast.Expr) (string, bool) {
 	}
 }
 
-func readSymbolsFromStdin() ([]string, error) {
+// moduleRoot returns the module root given as an argument, in
+// SYMBOLPRINT_ROOT or found from the current directory, in that order.
+func moduleRoot(args []string, opts *options) string {
+	var rootDir string
+	if len(args) == 1 {
+		rootDir = args[0]
+	} else if env := os.Getenv("SYMBOLPRINT_ROOT"); env != "" {
+		if _, err := os.Stat(filepath.Join(env, "go.mod")); err != nil {
+			log.Fatalf("SYMBOLPRINT_ROOT %q is not a module root: %v", env, err)
+		}
+		rootDir = env
+	} else {
+		root, err := findModuleRoot(".")
+		switch {
+		case err == nil:
+			rootDir = root
+			opts.autoRoot = true
+		case gopathRoot("."):
+			rootDir = "."
+		default:
+			log.Fatalf("no module root given: %v, and the current directory is not under GOPATH/src (%s)", err, build.Default.GOPATH)
+		}
+	}
+
+	if err := checkRoot(rootDir); err != nil {
+		log.Fatal(err)
+	}
+	return rootDir
+}
+
+// checkRoot reports a module root that does not exist or is not a
+// directory, before packages.Load fails on it less clearly.
+func checkRoot(dir string) error {
+	fi, err := os.Stat(dir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("module root %q does not exist", dir)
+	case err != nil:
+		return fmt.Errorf("module root %q: %w", dir, err)
+	case !fi.IsDir():
+		return fmt.Errorf("module root must be a directory, got %s", dir)
+	}
+	return nil
+}
+
+func readSymbolsFromStdin(parser SymbolParser, graph *callGraph) ([]string, error) {
+	r, err := maybeGunzip(os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	return readSymbols(r, parser, graph)
+}
+
+func maybeGunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// readSymbols parses every non-empty line of r. If graph is not nil, the
+// call edges described by the input are recorded in it.
+func readSymbols(r io.Reader, parser SymbolParser, graph *callGraph) ([]string, error) {
+	ep, _ := parser.(edgeParser)
 	var symbols []string
-	scanner := bufio.NewScanner(os.Stdin)
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" {
 			continue
 		}
-		if strings.Contains(line, "->") {
-			parts := strings.Split(line, "->")
-			if len(parts) == 2 {
-				left := strings.TrimSpace(parts[0])
-				right := strings.TrimSpace(parts[1])
-				if left != "" {
-					symbols = append(symbols, left)
-				}
-				if right != "" {
-					symbols = append(symbols, right)
-				}
+		syms, err := parser.ParseLine(line)
+		if err != nil {
+			log.Printf("skip line %q: %v\n", line, err)
+			continue
+		}
+		symbols = append(symbols, syms...)
+		if graph != nil && ep != nil {
+			if caller, callee, ok := ep.ParseEdge(line); ok {
+				graph.add(caller, callee)
 			}
-		} else {
-			symbols = append(symbols, line)
 		}
 	}
 	if err := scanner.Err(); err != nil {
@@ -298,10 +2972,156 @@ func readSymbolsFromStdin() ([]string, error) {
 	return symbols, nil
 }
 
+func stripTypeArgs(symbol string) (string, error) {
+	if !strings.Contains(symbol, "[") {
+		return symbol, nil
+	}
+	var b strings.Builder
+	depth := 0
+	for _, r := range symbol {
+		switch {
+		case r == '[':
+			depth++
+		case r == ']':
+			depth--
+			if depth < 0 {
+				return "", fmt.Errorf("unbalanced ']' in %s", symbol)
+			}
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+	if depth != 0 {
+		return "", fmt.Errorf("unbalanced '[' in %s", symbol)
+	}
+	return b.String(), nil
+}
+
+// splitNestedReceiver splits `mod/v2.T` into `mod/v2` and `T` when the last
+// path element contains a dot followed by an identifier.
+func splitNestedReceiver(pkgPath string) (parent, recv string, ok bool) {
+	identRegex := regexp.MustCompile(`^[\p{L}_][\p{L}\p{N}_]*$`)
+
+	dot := strings.LastIndex(pkgPath, ".")
+	if dot <= strings.LastIndex(pkgPath, "/") || !identRegex.MatchString(pkgPath[dot+1:]) {
+		return "", "", false
+	}
+	return pkgPath[:dot], pkgPath[dot+1:], true
+}
+
+// echoSymbols prints the canonical form of each input symbol as parsed,
+// without loading anything.
+func echoSymbols(w io.Writer, symbols []string) {
+	for _, sym := range symbols {
+		canonical, err := parseCanonical(sym)
+		if err != nil {
+			log.Printf("skip symbol %q: %v\n", sym, err)
+			continue
+		}
+		fmt.Fprintln(w, canonical)
+	}
+}
+
+// emitSymbols prints the canonical form of each symbol that produced a
+// definition, once, by package path and then in definition order, so the
+// output can be fed back in as a cleaned-up symbol list.
+func emitSymbols(w io.Writer, results map[string]*printOutput) {
+	pkgPaths := make([]string, 0, len(results))
+	for pkgPath := range results {
+		pkgPaths = append(pkgPaths, pkgPath)
+	}
+	sort.Strings(pkgPaths)
+	seen := make(map[string]bool)
+	for _, pkgPath := range pkgPaths {
+		for _, def := range results[pkgPath].definitions {
+			for _, sym := range def.symbols {
+				canonical := canonicalSymbol(sym)
+				if !seen[canonical] {
+					seen[canonical] = true
+					fmt.Fprintln(w, canonical)
+				}
+			}
+		}
+	}
+}
+
+// canonicalSymbol is sym as printed by -echo-symbols, or sym itself if it
+// does not parse.
+func canonicalSymbol(sym string) string {
+	if canonical, err := parseCanonical(sym); err == nil {
+		return canonical
+	}
+	return sym
+}
+
+func parseCanonical(sym string) (string, error) {
+	rs, err := parseRangeSymbol(sym)
+	if err != nil {
+		return "", err
+	}
+	if rs != nil {
+		return fmt.Sprintf("%s:%s:%d-%d", rs.pkgPath, rs.file, rs.startLine, rs.endLine), nil
+	}
+	pkgPath, receiverType, isPtr, name, err := parseSymbol(sym)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case receiverType == "":
+		return fmt.Sprintf("%s.%s", pkgPath, name), nil
+	case isPtr:
+		return fmt.Sprintf("(*%s.%s).%s", pkgPath, receiverType, name), nil
+	default:
+		return fmt.Sprintf("(%s.%s).%s", pkgPath, receiverType, name), nil
+	}
+}
+
+// mainPackageDir returns the directory pattern the package `main` of a
+// symbol is loaded from: dir, relative to the module root unless absolute,
+// or the module root itself.
+func mainPackageDir(dir string) string {
+	if dir == "" {
+		return "."
+	}
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return "./" + filepath.ToSlash(filepath.Clean(dir))
+}
+
+// isFilesystemPath reports whether a symbol's package part is a directory
+// (absolute, or relative to the module root) rather than an import path.
+func isFilesystemPath(pkgPath string) bool {
+	return strings.HasPrefix(pkgPath, "/") || strings.HasPrefix(pkgPath, ".")
+}
+
+// stripPosition removes a trailing `:line` or `:line:col` as appended by
+// compilers and linters, returning the line (0 if there was none).
+func stripPosition(symbol string) (string, int) {
+	posRegex := regexp.MustCompile(`^(.+?):(\d+)(?::\d+)?$`)
+
+	m := posRegex.FindStringSubmatch(symbol)
+	if m == nil || strings.HasSuffix(m[1], ".go") {
+		return symbol, 0
+	}
+	line, err := strconv.Atoi(m[2])
+	if err != nil {
+		return symbol, 0
+	}
+	return m[1], line
+}
+
 func parseSymbol(symbol string) (pkgPath, receiverType string, isPtr bool, funcOrTypeName string, err error) {
 	methodRegex := regexp.MustCompile(`^\(\*?([^)]+)\)\.([^.]+)$`)
 	funcRegex := regexp.MustCompile(`^(.+)\.([^.]+)$`)
 
+	_, symbol = splitKindHint(symbol)
+	symbol, _ = stripPosition(symbol)
+	symbol, err = stripTypeArgs(symbol)
+	if err != nil {
+		return
+	}
+
 	switch {
 	case methodRegex.MatchString(symbol):
 		m := methodRegex.FindStringSubmatch(symbol)
@@ -313,6 +3133,11 @@ func parseSymbol(symbol string) (pkgPath, receiverType string, isPtr bool, funcO
 		funcOrTypeName = m[2]
 		isPtr = strings.HasPrefix(symbol, "(*")
 
+		// `(/path/to/pkg).Func` names a function of a package directory.
+		if isFilesystemPath(raw) && strings.LastIndex(raw, ".") < strings.LastIndex(raw, "/") && !isPtr {
+			pkgPath = raw
+			return
+		}
 		lastDot := strings.LastIndex(raw, ".")
 		if lastDot == -1 {
 			err = fmt.Errorf("cannot split pkgPath and type from %q", raw)
@@ -338,10 +3163,80 @@ func parseSymbol(symbol string) (pkgPath, receiverType string, isPtr bool, funcO
 	return
 }
 
-func loadPackages(dir, importPath string) ([]*packages.Package, error) {
+func parseRangeSymbol(symbol string) (*rangeSymbol, error) {
+	rangeRegex := regexp.MustCompile(`^(.+):([^:]+\.go):(\d+)(?:-(\d+))?$`)
+
+	m := rangeRegex.FindStringSubmatch(symbol)
+	if m == nil {
+		return nil, nil
+	}
+	startLine, err := strconv.Atoi(m[3])
+	if err != nil {
+		return nil, fmt.Errorf("invalid start line in %q: %w", symbol, err)
+	}
+	endLine := startLine
+	if m[4] != "" {
+		endLine, err = strconv.Atoi(m[4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid end line in %q: %w", symbol, err)
+		}
+	}
+	if startLine < 1 || endLine < startLine {
+		return nil, fmt.Errorf("invalid line range %d-%d in %q", startLine, endLine, symbol)
+	}
+	return &rangeSymbol{
+		pkgPath:   m[1],
+		file:      m[2],
+		startLine: startLine,
+		endLine:   endLine,
+	}, nil
+}
+
+func loadPackage(absRoot, pkgPath string, opts *options) (*packages.Package, error) {
+	if opts.testVariant != "" {
+		return loadTestVariant(absRoot, pkgPath, opts)
+	}
+	if opts.lang != "" || singleByteEncoding(opts.encoding) {
+		return loadSyntaxOnly(absRoot, pkgPath, opts)
+	}
+	// Cached packages are re-parsed without type information.
+	if opts.cacheDir != "" && !needsTypes(opts) {
+		if pkg, ok := loadCachedPackage(opts.cacheDir, absRoot, pkgPath); ok {
+			return pkg, nil
+		}
+	}
+	pkgs, err := loadPackages(absRoot, pkgPath, opts.loadErrorsOK)
+	if err != nil && opts.autoRoot {
+		if r, ok := replacedModule(absRoot, pkgPath); ok {
+			err = fmt.Errorf("%w (module %s is replaced by %s)", err, r.Old.Path, r.New.Path)
+		} else if cached, cacheErr := loadFromModuleCache(pkgPath, opts.loadErrorsOK); cacheErr == nil {
+			pkgs, err = cached, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	pkg := pkgs[0]
+	if opts.cacheDir != "" && len(pkg.Syntax) > 0 {
+		if err := storeCachedPackage(opts.cacheDir, absRoot, pkg); err != nil {
+			log.Printf("failed to write cache for %q: %v\n", pkgPath, err)
+		}
+	}
+	return pkg, nil
+}
+
+// needsTypes reports whether opts asks for something that is looked up in
+// the package's type information rather than its syntax.
+func needsTypes(opts *options) bool {
+	return opts.withUnderlying || opts.resolveEmbeddedFields || opts.inlineTypes ||
+		opts.withConstraints || opts.expandInterfaces || opts.withConstructor
+}
+
+func loadPackages(dir, importPath string, errorsOK bool) ([]*packages.Package, error) {
 	cfg := &packages.Config{
 		Dir:   dir,
-		Mode:  packages.NeedName | packages.NeedTypes | packages.NeedSyntax | packages.NeedCompiledGoFiles,
+		Env:   loadEnv(dir),
+		Mode:  packages.NeedName | packages.NeedTypes | packages.NeedTypesInfo | packages.NeedSyntax | packages.NeedCompiledGoFiles,
 		Tests: false,
 	}
 	pkgs, err := packages.Load(cfg, importPath)
@@ -349,8 +3244,8 @@ func loadPackages(dir, importPath string) ([]*packages.Package, error) {
 		return nil, fmt.Errorf("packages.Load error: %w", err)
 	}
 	for _, p := range pkgs {
-		if len(p.Errors) > 0 {
-			return nil, fmt.Errorf("package load error: %v", p.Errors)
+		if err := checkPackageErrors(p, errorsOK); err != nil {
+			return nil, err
 		}
 	}
 	if len(pkgs) == 0 {
@@ -358,3 +3253,17 @@ func loadPackages(dir, importPath string) ([]*packages.Package, error) {
 	}
 	return pkgs, nil
 }
+
+func checkPackageErrors(p *packages.Package, errorsOK bool) error {
+	if len(p.Errors) == 0 {
+		return nil
+	}
+	// With -load-errors-ok, whatever did parse is still usable.
+	if !errorsOK || len(p.Syntax) == 0 {
+		return fmt.Errorf("package load error: %v", p.Errors)
+	}
+	for _, e := range p.Errors {
+		log.Printf("warning: %s: %v\n", p.PkgPath, e)
+	}
+	return nil
+}
@@ -0,0 +1,818 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"go/parser"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testOptions returns the options main starts from when no flag is given.
+func testOptions() *options {
+	return &options{
+		format:          "plain",
+		prefer:          "func",
+		group:           "package",
+		jobs:            1,
+		parser:          "default",
+		divider:         strings.Repeat("-", 50),
+		plainStyle:      "full",
+		onNotFound:      "skip",
+		encoding:        "utf-8",
+		sortDefs:        "position",
+		streamBatch:     100,
+		streamIdle:      500 * time.Millisecond,
+		licenseKeywords: "Copyright,License,SPDX-License-Identifier",
+	}
+}
+
+// fixtureRoot is the module in testdata the extraction tests resolve in.
+func fixtureRoot(t *testing.T) string {
+	t.Helper()
+	root, err := filepath.Abs(filepath.Join("testdata", "fx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// writeModule writes files, keyed by slash-separated path, below a new
+// temporary directory and returns it.
+func writeModule(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// resolve resolves symbols in the module at root as extract does, without
+// printing anything.
+func resolve(t *testing.T, root string, opts *options, symbols ...string) map[string]*printOutput {
+	t.Helper()
+	plan := planExtraction(symbols, opts)
+	return resolvePackages(root, plan.symbolsByPkg, newIndexCache(), opts)
+}
+
+// sourceOf returns the source of the definition sym resolved to.
+func sourceOf(t *testing.T, results map[string]*printOutput, sym string) string {
+	t.Helper()
+	def := definitionOf(t, results, sym)
+	if def == nil {
+		return ""
+	}
+	return def.source
+}
+
+func definitionOf(t *testing.T, results map[string]*printOutput, sym string) *definition {
+	t.Helper()
+	for _, out := range results {
+		for _, def := range out.definitions {
+			if def.hasSymbol(sym) {
+				return def
+			}
+		}
+	}
+	t.Errorf("%s did not resolve", sym)
+	return nil
+}
+
+func TestWithLineComments(t *testing.T) {
+	root := fixtureRoot(t)
+	tests := []struct {
+		sym       string
+		lineComms bool
+		want      string
+	}{
+		{"example.com/fx/decl.MaxSize", false, "const MaxSize = 100"},
+		{"example.com/fx/decl.MaxSize", true, "const MaxSize = 100 // bytes"},
+		// The doc comment of the next spec stays with it.
+		{"example.com/fx/decl.MinSize", true, "const MinSize = 1"},
+		{"example.com/fx/decl.Server.Addr", false, "// field of Server\nAddr string"},
+		{"example.com/fx/decl.Server.Addr", true, "// field of Server\nAddr string // listen address"},
+		{"example.com/fx/decl.Server.Port", true, "// field of Server\nPort int"},
+	}
+	for _, tt := range tests {
+		opts := testOptions()
+		opts.withLineComments = tt.lineComms
+		results := resolve(t, root, opts, tt.sym)
+		if got := sourceOf(t, results, tt.sym); got != tt.want {
+			t.Errorf("%s with -with-line-comments=%v:\ngot  %q\nwant %q", tt.sym, tt.lineComms, got, tt.want)
+		}
+	}
+}
+
+func TestResolveConcurrently(t *testing.T) {
+	root := fixtureRoot(t)
+	symbols := []string{
+		"example.com/fx/decl.MaxSize",
+		"example.com/fx/decl.Keys",
+		"(*example.com/fx/decl.Server).Serve",
+		"example.com/fx/decl.Server.Addr",
+		"example.com/fx/decl.Server.Port",
+		"example.com/fx/gen.Apply",
+		"example.com/fx/gen.Dict",
+		"example.com/bar/v2.New",
+	}
+	render := func(jobs int) string {
+		opts := testOptions()
+		opts.jobs = jobs
+		var b strings.Builder
+		for _, sec := range buildSections(resolve(t, root, opts, symbols...), opts.group, root) {
+			fmt.Fprintln(&b, sec.title)
+			for _, def := range sec.definitions {
+				fmt.Fprintln(&b, def.source)
+			}
+		}
+		return b.String()
+	}
+	want := render(1)
+	for _, sym := range symbols {
+		if !strings.Contains(want, sym[strings.LastIndexAny(sym, ".")+1:]) {
+			t.Errorf("%s missing from sequential output", sym)
+		}
+	}
+	// Run with -race: every package is loaded and indexed on its own
+	// goroutine while the main goroutine waits for all of them.
+	if got := render(8); got != want {
+		t.Errorf("-j 8 output differs from -j 1:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSignaturesOfGenericFuncs(t *testing.T) {
+	root := fixtureRoot(t)
+	tests := []struct{ sym, want string }{
+		{"example.com/fx/decl.Keys", "func Keys[K comparable, V any](m map[K]V) []K"},
+		{"example.com/fx/decl.MapSlice", "func MapSlice[T, U any](xs []T, f func(T) U) []U"},
+		{"example.com/fx/gen.Apply", "func Apply[T any](x T) T"},
+		{"(*example.com/fx/gen.Box).Value", "func (b *Box[T]) Value() T"},
+		{"(*example.com/fx/gen.Dict).Get", "func (d *Dict[K, V]) Get(k K) V"},
+	}
+	opts := testOptions()
+	opts.signatures = true
+	for _, tt := range tests {
+		results := resolve(t, root, opts, tt.sym)
+		if got := sourceOf(t, results, tt.sym); got != tt.want {
+			t.Errorf("-signatures %s:\ngot  %q\nwant %q", tt.sym, got, tt.want)
+		}
+	}
+}
+
+func TestOutline(t *testing.T) {
+	root := fixtureRoot(t)
+	tests := []struct{ sym, want string }{
+		{"example.com/fx/decl.Server", "type Server struct {\n\tAddr string // listen address\n\tPort int\n}"},
+		{"example.com/fx/decl.Handler", "type Handler interface {\n\tServe(s *Server) error\n\tClose() error\n}"},
+		{"(*example.com/fx/decl.Server).Serve", "func (s *Server) Serve(h Handler) error { ... }"},
+		{"(*example.com/fx/decl.Server).Close", "func (*Server) Close() error { ... }"},
+	}
+	opts := testOptions()
+	opts.outline = true
+	for _, tt := range tests {
+		results := resolve(t, root, opts, tt.sym)
+		if got := sourceOf(t, results, tt.sym); got != tt.want {
+			t.Errorf("-outline %s:\ngot  %q\nwant %q", tt.sym, got, tt.want)
+		}
+	}
+}
+
+func TestExtractGeneratedFile(t *testing.T) {
+	root := writeModule(t, map[string]string{
+		"go.mod":          "module example.com/g\n\ngo 1.21\n",
+		"zz_generated.go": "// Code generated by stringer. DO NOT EDIT.\n\npackage g\n\nfunc Gen() int { return 1 }\n",
+	})
+	file := filepath.Join(root, "zz_generated.go")
+	key := functionKey{funcName: "Gen"}
+	index := func() *packageIndex {
+		pkg, err := loadPackage(root, "example.com/g", testOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buildPackageIndex(pkg, testOptions())
+	}
+
+	def, ok, err := index().resolveKey(key)
+	if err != nil || !ok {
+		t.Fatalf("resolveKey(Gen) = %v, %v", ok, err)
+	}
+	if def.source != "func Gen() int { return 1 }" || def.srcFile != file {
+		t.Errorf("got %q from %s", def.source, def.srcFile)
+	}
+
+	idx := index()
+	if err := os.WriteFile(file, []byte("// Code generated by stringer. DO NOT EDIT.\n\npackage g\n\n// grown\nfunc Gen() int { return 1 }\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := idx.resolveKey(key); err == nil || !strings.Contains(err.Error(), "changed since it was parsed") {
+		t.Errorf("after the file grew: err = %v", err)
+	}
+
+	idx = index()
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := idx.resolveKey(key); err == nil || !strings.Contains(err.Error(), "cannot read file") {
+		t.Errorf("after the file was removed: err = %v", err)
+	}
+}
+
+func TestReadGzippedSymbols(t *testing.T) {
+	input := "example.com/fx/decl.Keys\n(*example.com/fx/gen.Dict).Get\n"
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(input))
+	zw.Close()
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  []string
+	}{
+		{"gzip", gz.Bytes(), []string{"example.com/fx/decl.Keys", "(*example.com/fx/gen.Dict).Get"}},
+		{"plain", []byte(input), []string{"example.com/fx/decl.Keys", "(*example.com/fx/gen.Dict).Get"}},
+		// Peeking the magic bytes must not lose input shorter than them.
+		{"one byte", []byte("x"), []string{"x"}},
+		{"empty", nil, nil},
+	}
+	for _, tt := range tests {
+		r, err := maybeGunzip(bytes.NewReader(tt.input))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := readSymbols(r, defaultParser{}, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUnexportedSymbols(t *testing.T) {
+	root := fixtureRoot(t)
+	tests := []struct{ sym, want string }{
+		{"example.com/fx/decl.helperFunc", "func helperFunc() int {\n\treturn 1\n}"},
+		{"example.com/fx/decl.internalState", "type internalState struct {\n\tn int\n}"},
+		{"(*example.com/fx/decl.internalState).reset", "func (s *internalState) reset() {\n\ts.n = 0\n}"},
+	}
+	for _, tt := range tests {
+		results := resolve(t, root, testOptions(), tt.sym)
+		if got := sourceOf(t, results, tt.sym); got != tt.want {
+			t.Errorf("%s:\ngot  %q\nwant %q", tt.sym, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeReceiver(t *testing.T) {
+	root := fixtureRoot(t)
+	tests := []struct {
+		sym       string
+		mode      string
+		normalize bool
+		want      string
+	}{
+		{"(*example.com/fx/decl.Server).Close", "signatures", true, "func (*Server) Close() error"},
+		{"(example.com/fx/decl.Server).String", "signatures", false, "func (s Server) String() string"},
+		{"(example.com/fx/decl.Server).String", "signatures", true, "func (Server) String() string"},
+		{"(example.com/fx/decl.Server).String", "outline", true, "func (Server) String() string { ... }"},
+		{"(*example.com/fx/gen.Box).Value", "signatures", true, "func (*Box[T]) Value() T"},
+		{"(*example.com/fx/gen.Dict).Get", "signatures", true, "func (*Dict[K, V]) Get(k K) V"},
+		// Full bodies keep the name they may refer to.
+		{"(example.com/fx/decl.Server).String", "", true, "func (s Server) String() string { return s.Addr }"},
+	}
+	for _, tt := range tests {
+		opts := testOptions()
+		opts.normalizeReceiver = tt.normalize
+		opts.signatures = tt.mode == "signatures"
+		opts.outline = tt.mode == "outline"
+		results := resolve(t, root, opts, tt.sym)
+		if got := sourceOf(t, results, tt.sym); got != tt.want {
+			t.Errorf("%s with -%s -normalize-receiver=%v:\ngot  %q\nwant %q", tt.sym, tt.mode, tt.normalize, got, tt.want)
+		}
+	}
+}
+
+func TestMajorVersionPaths(t *testing.T) {
+	root := fixtureRoot(t)
+	tests := []struct{ sym, want string }{
+		{"example.com/bar/v2.New", "func New(addr string) *Client {"},
+		{"(*example.com/bar/v2.Client).Do", "func (c *Client) Do() error {"},
+		// The package `example.com/bar/v2.Client` does not exist, so the
+		// last element is read as the receiver of Do.
+		{"example.com/bar/v2.Client.Do", "func (c *Client) Do() error {"},
+		{"example.com/bar/v2.Client.addr", "// field of Client\naddr string"},
+	}
+	for _, tt := range tests {
+		results := resolve(t, root, testOptions(), tt.sym)
+		if got := sourceOf(t, results, tt.sym); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%s: got %q, want prefix %q", tt.sym, got, tt.want)
+		}
+		if _, ok := results["example.com/bar/v2"]; !ok {
+			t.Errorf("%s: results not keyed by example.com/bar/v2", tt.sym)
+		}
+	}
+}
+
+func TestSplitNestedReceiver(t *testing.T) {
+	tests := []struct {
+		in, parent, recv string
+		ok               bool
+	}{
+		{"github.com/foo/bar/v2.T", "github.com/foo/bar/v2", "T", true},
+		{"example.com/p.T", "example.com/p", "T", true},
+		{"github.com/foo/bar/v2", "", "", false},
+		// Only tried when the package itself does not load, which for
+		// gopkg.in/yaml.v3 it does.
+		{"gopkg.in/yaml.v3", "gopkg.in/yaml", "v3", true},
+		{"example.com/p.v1/sub", "", "", false},
+	}
+	for _, tt := range tests {
+		parent, recv, ok := splitNestedReceiver(tt.in)
+		if parent != tt.parent || recv != tt.recv || ok != tt.ok {
+			t.Errorf("splitNestedReceiver(%q) = %q, %q, %v; want %q, %q, %v", tt.in, parent, recv, ok, tt.parent, tt.recv, tt.ok)
+		}
+	}
+}
+
+func TestFuncWithoutBody(t *testing.T) {
+	root := fixtureRoot(t)
+	const sym = "example.com/fx/asm.Add"
+	const want = "func Add(a, b int) int\n// no Go body (assembly or external)"
+	for _, mode := range []string{"default", "signatures", "outline"} {
+		opts := testOptions()
+		opts.signatures = mode == "signatures"
+		opts.outline = mode == "outline"
+		results := resolve(t, root, opts, sym)
+		if got := sourceOf(t, results, sym); got != want {
+			t.Errorf("%s mode: got %q, want %q", mode, got, want)
+		}
+	}
+}
+
+func TestPositionSymbols(t *testing.T) {
+	root := fixtureRoot(t)
+	tests := []struct{ sym, want string }{
+		{"example.com/fx/decl.Keys:36", "func Keys[K comparable, V any](m map[K]V) []K {"},
+		{"example.com/fx/decl.Keys:36:1", "func Keys[K comparable, V any](m map[K]V) []K {"},
+		{"(*example.com/fx/decl.Server).Close:32:6", "func (*Server) Close() error { return nil }"},
+		{"example.com/fx/decl.MaxSize:11", "const MaxSize = 100"},
+	}
+	for _, tt := range tests {
+		results := resolve(t, root, testOptions(), tt.sym)
+		if got := sourceOf(t, results, tt.sym); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%s: got %q, want prefix %q", tt.sym, got, tt.want)
+		}
+	}
+}
+
+func TestPositionPicksDeclaration(t *testing.T) {
+	root := fixtureRoot(t)
+	// dup declares Dup in a.go (lines 4-6) and again in b.go (lines 3-5).
+	tests := []struct{ sym, want string }{
+		{"example.com/fx/dup.Dup:5", "return 1"},
+		{"example.com/fx/dup.Dup:4:1", "return 1"},
+		{"example.com/fx/dup.Dup:3", "return 2"},
+	}
+	for _, tt := range tests {
+		opts := testOptions()
+		opts.loadErrorsOK = true
+		results := resolve(t, root, opts, tt.sym)
+		if got := sourceOf(t, results, tt.sym); !strings.Contains(got, tt.want) {
+			t.Errorf("%s: got %q, want the declaration with %q", tt.sym, got, tt.want)
+		}
+	}
+}
+
+func TestFuncBody(t *testing.T) {
+	root := fixtureRoot(t)
+	const lit = "func(s *Server, h Handler) error {\n\treturn h.Serve(s)\n}"
+	tests := []struct {
+		sym      string
+		funcBody bool
+		want     string
+	}{
+		{"example.com/fx/decl.OnServe", false, "var OnServe = " + lit},
+		{"example.com/fx/decl.OnServe", true, lit},
+		// A value other than a function literal is printed whole either way.
+		{"example.com/fx/decl.Default", false, `var Default = &Server{Addr: "localhost"}`},
+		{"example.com/fx/decl.Default", true, `var Default = &Server{Addr: "localhost"}`},
+	}
+	for _, tt := range tests {
+		opts := testOptions()
+		opts.funcBody = tt.funcBody
+		results := resolve(t, root, opts, tt.sym)
+		if got := sourceOf(t, results, tt.sym); got != tt.want {
+			t.Errorf("%s with -func-body=%v:\ngot  %q\nwant %q", tt.sym, tt.funcBody, got, tt.want)
+		}
+	}
+}
+
+func TestOverlappingRequestsPrintOnce(t *testing.T) {
+	root := fixtureRoot(t)
+	tests := []struct {
+		name    string
+		expand  bool
+		symbols []string
+	}{
+		{"type and its methods with -expand-to-type", true, []string{
+			"example.com/fx/decl.Server",
+			"(*example.com/fx/decl.Server).Serve",
+			"(example.com/fx/decl.Server).String",
+		}},
+		{"two consts of one group", false, []string{
+			"example.com/fx/decl.MaxSize",
+			"example.com/fx/decl.MaxSize:11",
+		}},
+		{"a range and a function inside it", false, []string{
+			"example.com/fx/decl:decl.go:35-42",
+			"example.com/fx/decl.Keys",
+		}},
+	}
+	for _, tt := range tests {
+		opts := testOptions()
+		opts.expandToType = tt.expand
+		results := resolve(t, root, opts, tt.symbols...)
+		seen := make(map[string]bool)
+		for _, def := range results["example.com/fx/decl"].definitions {
+			key := fmt.Sprintf("%s:%d", def.srcFile, def.offset)
+			if seen[key] {
+				t.Errorf("%s: declaration at %s:%d printed twice", tt.name, filepath.Base(def.file), def.startLine)
+			}
+			seen[key] = true
+		}
+		for _, sym := range tt.symbols {
+			definitionOf(t, results, sym)
+		}
+	}
+}
+
+func TestFilesystemPathSymbols(t *testing.T) {
+	root := fixtureRoot(t)
+	abs := filepath.Join(root, "decl")
+	for _, sym := range []string{
+		"./decl.Keys",
+		"(./decl).Keys",
+		"(" + abs + ").Keys",
+		"(*./decl.Server).Close",
+	} {
+		results := resolve(t, root, testOptions(), sym)
+		if _, ok := results["example.com/fx/decl"]; !ok {
+			t.Errorf("%s: results not keyed by the import path: %v", sym, results)
+		}
+		if got := sourceOf(t, results, sym); !strings.HasPrefix(got, "func ") {
+			t.Errorf("%s: got %q", sym, got)
+		}
+	}
+}
+
+func TestDryRunLoadsNothing(t *testing.T) {
+	// Neither package exists, so loading either would fail.
+	symbols := []string{
+		"example.com/missing/a.F",
+		"(*example.com/missing/b.T).M",
+		"example.com/missing/a.G",
+		"example.com/missing/a.F",
+		"not a symbol",
+	}
+	var b strings.Builder
+	printPlan(&b, planExtraction(symbols, testOptions()))
+	want := "example.com/missing/a\n  example.com/missing/a.F\n  example.com/missing/a.G\n" +
+		"example.com/missing/b\n  (*example.com/missing/b.T).M\n" +
+		"2 packages, 3 symbols, 1 unparsed or skipped\n"
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestKindHints(t *testing.T) {
+	root := fixtureRoot(t)
+	tests := []struct {
+		sym      string
+		wantKind string // empty if the hint rules every declaration out
+	}{
+		{"func example.com/fx/decl.Keys", "func"},
+		{"method (*example.com/fx/decl.Server).Close", "method"},
+		{"type example.com/fx/decl.Server", "type"},
+		{"var example.com/fx/decl.Default", "var"},
+		{"const example.com/fx/decl.Limit", "const"},
+		{"example.com/fx/decl.Keys", "func"},
+		{"var example.com/fx/decl.Keys", ""},
+		{"func example.com/fx/decl.Server", ""},
+		{"type example.com/fx/decl.Default", ""},
+	}
+	for _, tt := range tests {
+		results := resolve(t, root, testOptions(), tt.sym)
+		var kind string
+		for _, def := range results["example.com/fx/decl"].definitions {
+			kind = def.kind
+		}
+		if kind != tt.wantKind {
+			t.Errorf("%s resolved to kind %q, want %q", tt.sym, kind, tt.wantKind)
+		}
+	}
+}
+
+func TestReceiverTypeStringTypeParams(t *testing.T) {
+	tests := []struct {
+		expr  string
+		name  string
+		isPtr bool
+	}{
+		{"Box[T]", "Box", false},
+		{"*Dict[K, V]", "Dict", true},
+		{"Dict[K, V]", "Dict", false},
+		{"*Tri[A, B, C]", "Tri", true},
+		{"(Tri[A, B, C])", "Tri", false},
+	}
+	for _, tt := range tests {
+		expr, err := parser.ParseExpr(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		name, isPtr := receiverTypeString(expr)
+		if name != tt.name || isPtr != tt.isPtr {
+			t.Errorf("receiverTypeString(%s) = %q, %v; want %q, %v", tt.expr, name, isPtr, tt.name, tt.isPtr)
+		}
+	}
+}
+
+func TestResolveMultiParamReceivers(t *testing.T) {
+	root := fixtureRoot(t)
+	tests := []struct{ sym, want string }{
+		{"(*example.com/fx/gen.Dict).Get", "func (d *Dict[K, V]) Get(k K) V {"},
+		{"(*example.com/fx/gen.Dict[K,V]).Get", "func (d *Dict[K, V]) Get(k K) V {"},
+		{"(*example.com/fx/gen.Dict[string, int]).Get", "func (d *Dict[K, V]) Get(k K) V {"},
+		{"(example.com/fx/gen.Tri).First", "func (t Tri[A, B, C]) First() A {"},
+		{"(example.com/fx/gen.Tri[A,B,C]).First", "func (t Tri[A, B, C]) First() A {"},
+		{"(example.com/fx/gen.Tri[int, string, []byte]).First", "func (t Tri[A, B, C]) First() A {"},
+	}
+	for _, tt := range tests {
+		results := resolve(t, root, testOptions(), tt.sym)
+		if got := sourceOf(t, results, tt.sym); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%s: got %q, want prefix %q", tt.sym, got, tt.want)
+		}
+	}
+}
+
+func TestOnNotFoundError(t *testing.T) {
+	root := fixtureRoot(t)
+	opts := testOptions()
+	opts.onNotFound = "error"
+	results := resolve(t, root, opts, "example.com/fx/decl.Keys", "example.com/fx/decl.Missing", "example.com/fx/gen.Gone")
+	err := checkNotFound(results, opts)
+	if !errors.Is(err, errNotFound) {
+		t.Fatalf("checkNotFound = %v, want errNotFound", err)
+	}
+	if want := "no declaration found for:\n  example.com/fx/decl.Missing\n  example.com/fx/gen.Gone"; err.Error() != want {
+		t.Errorf("checkNotFound:\ngot  %q\nwant %q", err, want)
+	}
+	if err := checkNotFound(resolve(t, root, opts, "example.com/fx/decl.Keys"), opts); err != nil {
+		t.Errorf("checkNotFound with every symbol found = %v, want nil", err)
+	}
+	opts.onNotFound = "skip"
+	if err := checkNotFound(results, opts); err != nil {
+		t.Errorf("checkNotFound with -on-not-found=skip = %v, want nil", err)
+	}
+}
+
+func TestOnNotFoundStub(t *testing.T) {
+	root := fixtureRoot(t)
+	symbols := []string{"Missing", "Keys", "Gone", "Server", "Dial"}
+	for i, sym := range symbols {
+		symbols[i] = "example.com/fx/decl." + sym
+	}
+	opts := testOptions()
+	opts.onNotFound = "stub"
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	results := resolve(t, root, opts, symbols...)
+	if strings.Contains(logs.String(), "No matching") {
+		t.Errorf("-on-not-found=stub logged the missing symbols:\n%s", logs.String())
+	}
+	sortDefinitions(results, "position")
+	out := results["example.com/fx/decl"]
+	if len(out.definitions) != 3 || len(out.unresolved) != 2 {
+		t.Fatalf("got %d definitions and unresolved %+v, want 3 and Missing, Gone", len(out.definitions), out.unresolved)
+	}
+
+	stubbed := withStubs(map[string]*printOutput{out.pkgPath: out})[out.pkgPath].definitions
+	var got []string
+	for _, def := range stubbed {
+		if def.kind == "stub" {
+			got = append(got, def.source)
+		} else {
+			got = append(got, def.name)
+		}
+	}
+	// Missing comes first in the input and Gone right after Keys.
+	want := []string{
+		"// TODO: example.com/fx/decl.Missing not found",
+		"Server",
+		"Keys",
+		"// TODO: example.com/fx/decl.Gone not found",
+		"Dial",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("withStubs:\ngot  %q\nwant %q", got, want)
+	}
+	if len(out.definitions) != 3 {
+		t.Error("withStubs changed the results it was given")
+	}
+}
+
+func TestQualifiedReceivers(t *testing.T) {
+	tests := []struct {
+		expr  string
+		name  string
+		isPtr bool
+	}{
+		{"T", "T", false},
+		{"*T", "T", true},
+		{"other.T", "T", false},
+		{"*other.T", "T", true},
+		{"*other.Dict[K, V]", "Dict", true},
+	}
+	for _, tt := range tests {
+		expr, err := parser.ParseExpr(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		name, isPtr := receiverTypeString(expr)
+		if name != tt.name || isPtr != tt.isPtr {
+			t.Errorf("receiverTypeString(%s) = %q, %v; want %q, %v", tt.expr, name, isPtr, tt.name, tt.isPtr)
+		}
+	}
+
+	// A qualified receiver does not type-check, so the package needs
+	// -load-errors-ok; the method is indexed under the bare type name.
+	root := writeModule(t, map[string]string{
+		"go.mod":     "module example.com/q\n\ngo 1.21\n",
+		"q.go":       "package q\n\nimport . \"example.com/q/other\"\n\nvar _ T\n",
+		"m.go":       "package q\n\nimport \"example.com/q/other\"\n\nfunc (p *other.T) M() {}\n",
+		"other/t.go": "package other\n\ntype T struct{}\n",
+	})
+	opts := testOptions()
+	opts.loadErrorsOK = true
+	const sym = "(*example.com/q.T).M"
+	if got := sourceOf(t, resolve(t, root, opts, sym), sym); got != "func (p *other.T) M() {}" {
+		t.Errorf("%s: got %q", sym, got)
+	}
+}
+
+func TestMainPackage(t *testing.T) {
+	root := fixtureRoot(t)
+	opts := testOptions()
+	opts.mainPkg = "cmd/tool"
+	results := resolve(t, root, opts, "main.run", "main.main")
+	if got := sourceOf(t, results, "main.run"); got != "func run() error {\n\treturn nil\n}" {
+		t.Errorf("main.run: got %q", got)
+	}
+	sourceOf(t, results, "main.main")
+
+	// The module root holds no package main.
+	out := resolve(t, root, testOptions(), "main.run")["main"]
+	if out == nil || len(out.definitions) != 0 || len(out.unresolved) != 1 || !strings.Contains(out.unresolved[0].Error, "-main-pkg") {
+		t.Errorf("main.run without -main-pkg: got %+v, want a load error pointing at -main-pkg", out)
+	}
+}
+
+func TestMainPackageDir(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"", "."},
+		{"cmd/tool", "./cmd/tool"},
+		{"./cmd/tool/", "./cmd/tool"},
+		{"/abs/cmd/tool", "/abs/cmd/tool"},
+	}
+	for _, tt := range tests {
+		if got := mainPackageDir(tt.in); got != tt.want {
+			t.Errorf("mainPackageDir(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLineDirectives(t *testing.T) {
+	root := fixtureRoot(t)
+	parsed := filepath.Join(root, "lined", "parser.go")
+	tests := []struct {
+		sym, want string
+		line      int
+	}{
+		{"example.com/fx/lined.Helper", "func Helper() int { return 1 }", 5},
+		{"example.com/fx/lined.Parse", "func Parse(s string) int {\n\treturn len(s) + Helper()\n}", 8},
+		{"example.com/fx/lined.Token", "type Token struct {\n\tKind int\n\tText string\n}", 13},
+	}
+	for _, tt := range tests {
+		def := definitionOf(t, resolve(t, root, testOptions(), tt.sym), tt.sym)
+		if def == nil {
+			continue
+		}
+		// grammar.y does not exist, so the location is that of parser.go.
+		if def.source != tt.want || def.file != parsed || def.srcFile != parsed || def.startLine != tt.line {
+			t.Errorf("%s: got %q at %s:%d (source file %s), want %q at parser.go:%d",
+				tt.sym, def.source, def.file, def.startLine, def.srcFile, tt.want, tt.line)
+		}
+	}
+}
+
+func TestLineDirectivesToExistingFile(t *testing.T) {
+	root := fixtureRoot(t)
+	symbols := []string{"example.com/fx/lined2.A", "example.com/fx/lined2.B"}
+
+	results := resolve(t, root, testOptions(), symbols...)
+	def := definitionOf(t, results, symbols[0])
+	if def != nil && (filepath.Base(def.file) != "gram.y" || def.startLine != 8 || filepath.Base(def.srcFile) != "parse.go") {
+		t.Errorf("A: reported at %s:%d, cut from %s; want gram.y:8 cut from parse.go", def.file, def.startLine, def.srcFile)
+	}
+
+	const joined = "func A() string { return \"a\" }\n\n//line gram.y:10\nfunc B() string { return \"b\" }"
+	if err := mergeBetween(results, symbols); err != nil {
+		t.Fatalf("-between: %v", err)
+	}
+	if got := sourceOf(t, results, symbols[0]); got != joined {
+		t.Errorf("-between: got %q, want %q", got, joined)
+	}
+
+	results = resolve(t, root, testOptions(), symbols...)
+	mergeConsecutive(results, "utf-8")
+	if defs := results["example.com/fx/lined2"].definitions; len(defs) != 1 || defs[0].source != joined {
+		t.Errorf("-merge-consecutive: got %d definitions, want one with %q", len(defs), joined)
+	}
+}
+
+func TestGoFileImports(t *testing.T) {
+	root := fixtureRoot(t)
+	// -lang loads syntax only, leaving the imports to be found by name.
+	for _, lang := range []string{"", "go1.21"} {
+		opts := testOptions()
+		opts.format = "go"
+		opts.lang = lang
+		results := resolve(t, root, opts, "example.com/fx/rnd.Roll", "example.com/fx/rnd.Token", "example.com/fx/rnd.Len")
+		secs := buildSections(results, opts.group, root)
+		if len(secs) != 1 {
+			t.Fatalf("-lang=%q: got %d sections, want 1", lang, len(secs))
+		}
+		got := string(goFileSource(secs[0]))
+		for _, want := range []string{
+			"import (\n\trand2 \"crypto/rand\"\n\t\"math/rand\"\n)",
+			"return rand.Intn(6) + 1",
+			"rand2.Read(b)",
+			"return strings.n",
+		} {
+			if !strings.Contains(got, want) {
+				t.Errorf("-lang=%q: generated file lacks %q:\n%s", lang, want, got)
+			}
+		}
+		if strings.Contains(got, `"strings"`) {
+			t.Errorf("-lang=%q: generated file imports strings for a parameter of that name:\n%s", lang, got)
+		}
+	}
+}
+
+func TestPerPackageLimit(t *testing.T) {
+	root := fixtureRoot(t)
+	opts := testOptions()
+	results := resolve(t, root, opts, "example.com/fx/decl.helperFunc", "example.com/fx/decl.Handler", "example.com/fx/decl.Server")
+	limitDefinitions(results, 2)
+	sortDefinitions(results, "position")
+	out := results["example.com/fx/decl"]
+	var got []string
+	for _, def := range out.definitions {
+		got = append(got, def.name)
+	}
+	// helperFunc comes first in the input but last by position.
+	if strings.Join(got, " ") != "Handler helperFunc" || out.omitted != 1 {
+		t.Errorf("got %v and %d omitted, want [Handler helperFunc] and 1 omitted", got, out.omitted)
+	}
+}
+
+func TestContextDecl(t *testing.T) {
+	root := fixtureRoot(t)
+	tests := []struct{ sym, want string }{
+		{"example.com/fx/decl.Step", "var (\n\tLo, Hi = 1, 2 // bounds\n\tStep   = 3 // <-- requested\n)"},
+		{"example.com/fx/decl.Hi", "var (\n\t// requested:\n\tLo, Hi = 1, 2 // bounds\n\tStep   = 3\n)"},
+	}
+	for _, tt := range tests {
+		opts := testOptions()
+		opts.contextDecl = true
+		results := resolve(t, root, opts, tt.sym)
+		if got := sourceOf(t, results, tt.sym); got != tt.want {
+			t.Errorf("%s:\ngot  %q\nwant %q", tt.sym, got, tt.want)
+		}
+	}
+}
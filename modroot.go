@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/build"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/tools/go/packages"
+)
+
+func findModuleRoot(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		if fi, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil && !fi.IsDir() {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", errors.New("no go.mod found in the current directory or any parent")
+		}
+		dir = parent
+	}
+}
+
+// gopathRoot reports whether dir, which has no go.mod at or above it, lies
+// under the src directory of a GOPATH entry, i.e. is a GOPATH-mode project.
+func gopathRoot(dir string) bool {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	if _, err := findModuleRoot(dir); err == nil {
+		return false
+	}
+	for _, gopath := range filepath.SplitList(build.Default.GOPATH) {
+		rel, err := filepath.Rel(filepath.Join(gopath, "src"), dir)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadEnv is the environment packages are loaded with from dir: GOPATH-mode
+// projects are loaded with modules turned off so import paths resolve under
+// GOPATH/src.
+func loadEnv(dir string) []string {
+	if !gopathRoot(dir) {
+		return nil
+	}
+	return append(os.Environ(), "GO111MODULE=off")
+}
+
+func moduleCacheRoot() (string, error) {
+	if dir := os.Getenv("GOMODCACHE"); dir != "" {
+		return dir, nil
+	}
+	out, err := exec.Command("go", "env", "GOMODCACHE").Output()
+	if err != nil {
+		return "", fmt.Errorf("go env GOMODCACHE: %w", err)
+	}
+	dir := strings.TrimSpace(string(out))
+	if dir == "" {
+		return "", errors.New("GOMODCACHE is not set")
+	}
+	return dir, nil
+}
+
+// moduleCacheDir finds the newest downloaded module that can contain
+// importPath, trying the longest module path first.
+func moduleCacheDir(importPath string) (string, error) {
+	cacheRoot, err := moduleCacheRoot()
+	if err != nil {
+		return "", err
+	}
+	for modPath := importPath; modPath != "." && modPath != "/"; modPath = filepath.ToSlash(filepath.Dir(modPath)) {
+		escaped, err := module.EscapePath(modPath)
+		if err != nil {
+			continue
+		}
+		matches, _ := filepath.Glob(filepath.Join(cacheRoot, filepath.FromSlash(escaped)+"@*"))
+		best, bestVersion := "", ""
+		for _, m := range matches {
+			v := m[strings.LastIndex(m, "@")+1:]
+			if semver.IsValid(v) && (bestVersion == "" || semver.Compare(v, bestVersion) > 0) {
+				best, bestVersion = m, v
+			}
+		}
+		if best != "" {
+			return best, nil
+		}
+	}
+	return "", fmt.Errorf("no module for %q in the module cache", importPath)
+}
+
+func loadFromModuleCache(importPath string, errorsOK bool) ([]*packages.Package, error) {
+	dir, err := moduleCacheDir(importPath)
+	if err != nil {
+		return nil, err
+	}
+	return loadPackages(dir, importPath, errorsOK)
+}
+
+// replacedModule reports the replace directive in absRoot/go.mod, if any,
+// whose module path contains importPath. Such packages are loaded from the
+// replacement by go list and must not fall back to the module cache.
+func replacedModule(absRoot, importPath string) (*modfile.Replace, bool) {
+	goMod := filepath.Join(absRoot, "go.mod")
+	data, err := os.ReadFile(goMod)
+	if err != nil {
+		return nil, false
+	}
+	f, err := modfile.Parse(goMod, data, nil)
+	if err != nil {
+		return nil, false
+	}
+	var best *modfile.Replace
+	for _, r := range f.Replace {
+		p := r.Old.Path
+		if (importPath == p || strings.HasPrefix(importPath, p+"/")) && (best == nil || len(p) > len(best.Old.Path)) {
+			best = r
+		}
+	}
+	return best, best != nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"go/build"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplacedModule(t *testing.T) {
+	root := fixtureRoot(t)
+	replacement, err := filepath.Abs(filepath.Join("testdata", "bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const sym = "example.com/bar/v2.New"
+	def := definitionOf(t, resolve(t, root, testOptions(), sym), sym)
+	if def != nil && !strings.HasPrefix(def.file, replacement+string(filepath.Separator)) {
+		t.Errorf("%s extracted from %s, want a file under %s", sym, def.file, replacement)
+	}
+
+	r, ok := replacedModule(root, "example.com/bar/v2")
+	if !ok || r.New.Path != "../bar" {
+		t.Errorf("replacedModule(example.com/bar/v2) = %v, %v; want the ../bar replacement", r, ok)
+	}
+	if _, ok := replacedModule(root, "example.com/fx/decl"); ok {
+		t.Error("replacedModule(example.com/fx/decl) reported a replacement")
+	}
+}
+
+func TestCheckRoot(t *testing.T) {
+	root := fixtureRoot(t)
+	tests := []struct {
+		dir     string
+		wantErr string
+	}{
+		{root, ""},
+		{filepath.Join(root, "decl", "decl.go"), "module root must be a directory"},
+		{filepath.Join(root, "missing"), "does not exist"},
+	}
+	for _, tt := range tests {
+		err := checkRoot(tt.dir)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("checkRoot(%s) = %v, want error containing %q", tt.dir, err, tt.wantErr)
+		}
+	}
+}
+
+func TestGOPATHProject(t *testing.T) {
+	// GOPATH mode needs a project with no go.mod above it, unlike testdata.
+	gopath := t.TempDir()
+	if err := os.CopyFS(gopath, os.DirFS(filepath.Join("testdata", "gopath"))); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOPATH", gopath)
+	defer func(old string) { build.Default.GOPATH = old }(build.Default.GOPATH)
+	build.Default.GOPATH = gopath
+
+	root := filepath.Join(gopath, "src", "legacy.org", "app")
+	if !gopathRoot(root) {
+		t.Fatalf("gopathRoot(%s) = false", root)
+	}
+	if gopathRoot(t.TempDir()) {
+		t.Error("gopathRoot reported a directory outside GOPATH/src")
+	}
+	if gopathRoot(fixtureRoot(t)) {
+		t.Error("gopathRoot reported a module")
+	}
+
+	tests := []struct{ sym, want string }{
+		{"legacy.org/app.Hello", "func Hello() string {"},
+		{"legacy.org/app/util.Greeting", `const Greeting = "hello"`},
+	}
+	for _, tt := range tests {
+		results := resolve(t, root, testOptions(), tt.sym)
+		if got := sourceOf(t, results, tt.sym); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%s: got %q, want prefix %q", tt.sym, got, tt.want)
+		}
+	}
+}
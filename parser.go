@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// SymbolParser turns one line of input into zero or more symbols written in
+// the canonical form understood by parseSymbol: `pkg/path.Name` or
+// `(*pkg/path.Type).Method`, i.e. a (pkgPath, receiver, isPtr, name) tuple.
+type SymbolParser interface {
+	ParseLine(line string) ([]string, error)
+}
+
+// edgeParser is implemented by parsers whose input lines can describe a
+// call edge; used by -show-relations.
+type edgeParser interface {
+	ParseEdge(line string) (caller, callee string, ok bool)
+}
+
+var symbolParsers = map[string]SymbolParser{
+	"default":      defaultParser{},
+	"go-callgraph": callgraphParser{},
+	"pprof":        pprofParser{},
+}
+
+func symbolParserNames() string {
+	names := make([]string, 0, len(symbolParsers))
+	for name := range symbolParsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func newSymbolParser(name string) (SymbolParser, error) {
+	p, ok := symbolParsers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown parser %q: must be one of %s", name, symbolParserNames())
+	}
+	return p, nil
+}
+
+// defaultParser accepts one symbol per line, or a `caller -> callee` edge
+// as printed by digraph and calldigraph. Several symbols on one line may be
+// separated by commas or whitespace.
+type defaultParser struct{}
+
+func (defaultParser) ParseLine(line string) ([]string, error) {
+	if !strings.Contains(line, "->") {
+		return splitSymbolList(line), nil
+	}
+	var symbols []string
+	parts := strings.Split(line, "->")
+	if len(parts) == 2 {
+		symbols = append(symbols, splitSymbolList(parts[0])...)
+		symbols = append(symbols, splitSymbolList(parts[1])...)
+	}
+	return symbols, nil
+}
+
+// splitSymbolList splits s on commas and runs of whitespace that are not
+// inside parentheses or brackets, so `(*pkg.T).M` and `pkg.Map[K, V]` stay
+// whole.
+func splitSymbolList(s string) []string {
+	var symbols []string
+	depth, start := 0, 0
+	flush := func(end int) {
+		if sym := strings.TrimSpace(s[start:end]); sym != "" {
+			symbols = append(symbols, sym)
+		}
+	}
+	for i, r := range s {
+		switch r {
+		case '(', '[':
+			depth++
+		case ')', ']':
+			depth--
+		case ',', ' ', '\t':
+			// A kind hint such as `func pkg.F` stays with its symbol.
+			if depth == 0 && !kindHints[strings.TrimSpace(s[start:i])] {
+				flush(i)
+				start = i + 1
+			}
+		}
+	}
+	flush(len(s))
+	return symbols
+}
+
+var kindHints = map[string]bool{"func": true, "method": true, "type": true, "var": true, "const": true}
+
+// splitKindHint separates a leading kind keyword from a symbol:
+// `method (*pkg.T).M` yields "method" and `(*pkg.T).M`.
+func splitKindHint(symbol string) (kind, rest string) {
+	if i := strings.IndexAny(symbol, " \t"); i > 0 && kindHints[symbol[:i]] {
+		return symbol[:i], strings.TrimSpace(symbol[i+1:])
+	}
+	return "", symbol
+}
+
+func (defaultParser) ParseEdge(line string) (string, string, bool) {
+	parts := strings.Split(line, "->")
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	callers, callees := splitSymbolList(parts[0]), splitSymbolList(parts[1])
+	if len(callers) != 1 || len(callees) != 1 {
+		return "", "", false
+	}
+	return callers[0], callees[0], true
+}
+
+// callgraphParser understands the output of golang.org/x/tools/cmd/callgraph:
+// the default `caller\t--static-12:3-->\tcallee` template and the quoted
+// `"caller" "callee"` pairs of -format=digraph.
+type callgraphParser struct{}
+
+func (callgraphParser) ParseLine(line string) ([]string, error) {
+	edgeRegex := regexp.MustCompile(`^(.+?)\s+--\S*-->\s+(.+)$`)
+
+	if m := edgeRegex.FindStringSubmatch(line); m != nil {
+		return []string{strings.TrimSpace(m[1]), strings.TrimSpace(m[2])}, nil
+	}
+	if strings.HasPrefix(line, `"`) {
+		var symbols []string
+		for _, f := range strings.Split(line, `" "`) {
+			if f = strings.Trim(f, `"`); f != "" {
+				symbols = append(symbols, f)
+			}
+		}
+		return symbols, nil
+	}
+	return []string{line}, nil
+}
+
+func (p callgraphParser) ParseEdge(line string) (string, string, bool) {
+	syms, err := p.ParseLine(line)
+	if err != nil || len(syms) != 2 {
+		return "", "", false
+	}
+	return syms[0], syms[1], true
+}
+
+// callGraph holds the caller -> callee edges read from the input.
+type callGraph struct {
+	callers map[string][]string
+	callees map[string][]string
+}
+
+func newCallGraph() *callGraph {
+	return &callGraph{
+		callers: make(map[string][]string),
+		callees: make(map[string][]string),
+	}
+}
+
+func (g *callGraph) add(caller, callee string) {
+	g.callers[callee] = append(g.callers[callee], caller)
+	g.callees[caller] = append(g.callees[caller], callee)
+}
+
+func (g *callGraph) callersOf(symbols []string) []string {
+	return related(g.callers, symbols)
+}
+
+func (g *callGraph) calleesOf(symbols []string) []string {
+	return related(g.callees, symbols)
+}
+
+func related(edges map[string][]string, symbols []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, sym := range symbols {
+		for _, s := range edges[sym] {
+			if !seen[s] {
+				seen[s] = true
+				out = append(out, s)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// pprofParser reads `go tool pprof -top`/`-list` style lines, taking the
+// function name from the last column and converting the runtime spelling
+// `pkg/path.(*Type).Method` into the canonical form. Header lines and
+// anything that is not a function name produce no symbols.
+type pprofParser struct{}
+
+func (pprofParser) ParseLine(line string) ([]string, error) {
+	identRegex := regexp.MustCompile(`^(\(\*)?[\p{L}_][\p{L}\p{N}_]*\)?$`)
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	name := fields[len(fields)-1]
+	if strings.HasPrefix(line, "ROUTINE") && len(fields) >= 3 {
+		name = fields[2]
+	}
+
+	name, err := stripTypeArgs(name)
+	if err != nil {
+		return nil, err
+	}
+	slash := strings.LastIndex(name, "/")
+	dot := strings.Index(name[slash+1:], ".")
+	if dot < 0 {
+		return nil, nil
+	}
+	dot += slash + 1
+	// The runtime escapes dots in the last path element as %2e.
+	pkgPath := strings.ReplaceAll(name[:dot], "%2e", ".")
+	parts := strings.Split(name[dot+1:], ".")
+
+	// Drop closure suffixes such as Func.func1 or (*T).M.func2.1.
+	for len(parts) > 1 && isClosureSuffix(parts[len(parts)-1]) {
+		parts = parts[:len(parts)-1]
+	}
+
+	if strings.ContainsAny(pkgPath, " ()") {
+		return nil, nil
+	}
+	for _, part := range parts {
+		if !identRegex.MatchString(part) {
+			return nil, nil
+		}
+	}
+
+	switch len(parts) {
+	case 1:
+		return []string{pkgPath + "." + parts[0]}, nil
+	case 2:
+		recv := parts[0]
+		if strings.HasPrefix(recv, "(*") && strings.HasSuffix(recv, ")") {
+			return []string{fmt.Sprintf("(*%s.%s).%s", pkgPath, recv[2:len(recv)-1], parts[1])}, nil
+		}
+		return []string{fmt.Sprintf("(%s.%s).%s", pkgPath, recv, parts[1])}, nil
+	default:
+		return nil, fmt.Errorf("unrecognized pprof function name %q", name)
+	}
+}
+
+func isClosureSuffix(s string) bool {
+	s = strings.TrimPrefix(s, "func")
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
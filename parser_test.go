@@ -0,0 +1,182 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStripTypeArgs(t *testing.T) {
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{"pkg.F", "pkg.F", false},
+		{"pkg.Map[int,string]", "pkg.Map", false},
+		{"pkg.Map[K,V[T]]", "pkg.Map", false},
+		{"pkg.Map[K, map[string][]V[T]]", "pkg.Map", false},
+		{"(*pkg.Cache[string]).Get", "(*pkg.Cache).Get", false},
+		{"(*pkg.Map[K, V[T]]).Get[U]", "(*pkg.Map).Get", false},
+		{"pkg.Map[K", "", true},
+		{"pkg.Map]K[", "", true},
+	}
+	for _, tt := range tests {
+		got, err := stripTypeArgs(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("stripTypeArgs(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseSymbol(t *testing.T) {
+	tests := []struct {
+		in       string
+		pkgPath  string
+		recv     string
+		isPtr    bool
+		name     string
+		parseErr bool
+	}{
+		{"example.com/p.F", "example.com/p", "", false, "F", false},
+		{"(example.com/p.T).M", "example.com/p", "T", false, "M", false},
+		{"(*example.com/p.T).M", "example.com/p", "T", true, "M", false},
+		{"example.com/p.Map[K,V[T]]", "example.com/p", "", false, "Map", false},
+		{"(*example.com/p.Map[K, V[T]]).Get", "example.com/p", "Map", true, "Get", false},
+		{"noDot", "", "", false, "", true},
+	}
+	for _, tt := range tests {
+		pkgPath, recv, isPtr, name, err := parseSymbol(tt.in)
+		if (err != nil) != tt.parseErr {
+			t.Errorf("parseSymbol(%q) error = %v, want error %v", tt.in, err, tt.parseErr)
+			continue
+		}
+		if pkgPath != tt.pkgPath || recv != tt.recv || isPtr != tt.isPtr || name != tt.name {
+			t.Errorf("parseSymbol(%q) = %q, %q, %v, %q; want %q, %q, %v, %q",
+				tt.in, pkgPath, recv, isPtr, name, tt.pkgPath, tt.recv, tt.isPtr, tt.name)
+		}
+	}
+}
+
+func TestResolveInstantiatedGenerics(t *testing.T) {
+	root := fixtureRoot(t)
+	tests := []struct{ sym, want string }{
+		{"example.com/fx/gen.Apply[int]", "func Apply[T any](x T) T {"},
+		{"example.com/fx/gen.Dict[string,example.com/fx/gen.Dict[int,int]]", "type Dict[K comparable, V any] struct {"},
+		{"(*example.com/fx/gen.Box[V[T]]).Value", "func (b *Box[T]) Value() T {"},
+		{"(*example.com/fx/gen.Dict[K,V[T]]).Get", "func (d *Dict[K, V]) Get(k K) V {"},
+	}
+	for _, tt := range tests {
+		results := resolve(t, root, testOptions(), tt.sym)
+		if got := sourceOf(t, results, tt.sym); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%s: got %q, want prefix %q", tt.sym, got, tt.want)
+		}
+	}
+}
+
+func TestParseRangeSymbol(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    *rangeSymbol
+		wantErr bool
+	}{
+		{"example.com/p:file.go:12", &rangeSymbol{"example.com/p", "file.go", 12, 12}, false},
+		{"example.com/p:sub/file.go:3-9", &rangeSymbol{"example.com/p", "sub/file.go", 3, 9}, false},
+		{"example.com/p.F", nil, false},
+		{"example.com/p.F:12", nil, false},
+		{"example.com/p:file.go:9-3", nil, true},
+		{"example.com/p:file.go:0", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRangeSymbol(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRangeSymbol(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+			t.Errorf("parseRangeSymbol(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSplitSymbolList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"pkg.A", []string{"pkg.A"}},
+		{"pkg.A, pkg.B, pkg.C", []string{"pkg.A", "pkg.B", "pkg.C"}},
+		{"pkg.A,pkg.B", []string{"pkg.A", "pkg.B"}},
+		{"pkg.A pkg.B\tpkg.C", []string{"pkg.A", "pkg.B", "pkg.C"}},
+		{"pkg.A   pkg.B", []string{"pkg.A", "pkg.B"}},
+		{"(*pkg.T).M, (pkg.U).N", []string{"(*pkg.T).M", "(pkg.U).N"}},
+		{"pkg.Map[K, V] (*pkg.Cache[K, V]).Get", []string{"pkg.Map[K, V]", "(*pkg.Cache[K, V]).Get"}},
+		{"func pkg.F, method (*pkg.T).M", []string{"func pkg.F", "method (*pkg.T).M"}},
+		{" , ", nil},
+	}
+	for _, tt := range tests {
+		got := splitSymbolList(tt.in)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("splitSymbolList(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultParserLine(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"pkg.A, pkg.B", []string{"pkg.A", "pkg.B"}},
+		{"pkg.A -> pkg.B", []string{"pkg.A", "pkg.B"}},
+		{"pkg.A, pkg.B -> (*pkg.T).M", []string{"pkg.A", "pkg.B", "(*pkg.T).M"}},
+	}
+	for _, tt := range tests {
+		got, err := defaultParser{}.ParseLine(tt.in)
+		if err != nil {
+			t.Fatalf("ParseLine(%q): %v", tt.in, err)
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("ParseLine(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestStripPosition(t *testing.T) {
+	tests := []struct {
+		in, want string
+		line     int
+	}{
+		{"pkg.Foo", "pkg.Foo", 0},
+		{"pkg.Foo:12", "pkg.Foo", 12},
+		{"pkg.Foo:12:3", "pkg.Foo", 12},
+		{"(*pkg.T).M:7:1", "(*pkg.T).M", 7},
+		{"pkg.Foo:x", "pkg.Foo:x", 0},
+		// A file range is not a position.
+		{"pkg:file.go:12", "pkg:file.go:12", 0},
+	}
+	for _, tt := range tests {
+		got, line := stripPosition(tt.in)
+		if got != tt.want || line != tt.line {
+			t.Errorf("stripPosition(%q) = %q, %d; want %q, %d", tt.in, got, line, tt.want, tt.line)
+		}
+	}
+}
+
+func TestSplitKindHint(t *testing.T) {
+	tests := []struct{ in, kind, rest string }{
+		{"func pkg.F", "func", "pkg.F"},
+		{"method (*pkg.T).M", "method", "(*pkg.T).M"},
+		{"type pkg.T", "type", "pkg.T"},
+		{"var pkg.V", "var", "pkg.V"},
+		{"const pkg.C", "const", "pkg.C"},
+		{"const\tpkg.C", "const", "pkg.C"},
+		{"pkg.F", "", "pkg.F"},
+		{"(*pkg.T).M", "", "(*pkg.T).M"},
+		{"function pkg.F", "", "function pkg.F"},
+	}
+	for _, tt := range tests {
+		kind, rest := splitKindHint(tt.in)
+		if kind != tt.kind || rest != tt.rest {
+			t.Errorf("splitKindHint(%q) = %q, %q; want %q, %q", tt.in, kind, rest, tt.kind, tt.rest)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+const defaultPrettyWidth = 80
+
+func prettyWidth(w io.Writer) int {
+	if f, ok := w.(*os.File); ok && isTerminal(f) {
+		if width, ok := terminalWidth(f); ok {
+			return width
+		}
+	}
+	return defaultPrettyWidth
+}
+
+// printPrettySection draws sec as a box as wide as the terminal, with the
+// package clause on the left of the top border, the title right-aligned and
+// the definitions indented inside.
+func printPrettySection(w io.Writer, sec *section, width int, headerPrinted map[string]bool, opts *options) {
+	left := "package " + sec.pkgName
+	right := sec.title
+	fill := width - utf8.RuneCountInString(left) - utf8.RuneCountInString(right) - 8
+	if fill < 1 {
+		fill = 1
+	}
+	fmt.Fprintf(w, "╭─ %s %s %s ─╮\n", left, strings.Repeat("─", fill), right)
+	fmt.Fprintln(w, "│")
+
+	var buf bytes.Buffer
+	printDefinitions(&buf, sec, headerPrinted, opts, nil)
+	if sec.omitted > 0 {
+		fmt.Fprintf(&buf, "\n... and %d more\n", sec.omitted)
+	}
+	for _, line := range strings.Split(strings.TrimRight(buf.String(), "\n"), "\n") {
+		if line == "" {
+			fmt.Fprintln(w, "│")
+			continue
+		}
+		fmt.Fprintf(w, "│   %s\n", line)
+	}
+
+	fmt.Fprintln(w, "│")
+	fmt.Fprintf(w, "╰%s╯\n\n", strings.Repeat("─", width-2))
+}
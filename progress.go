@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const progressInterval = time.Second
+
+// progress reports, for -progress, how many packages and symbols have been
+// resolved so far: redrawn in place on a terminal, one line per tick
+// otherwise.
+type progress struct {
+	w                    io.Writer
+	tty                  bool
+	totalPkgs, totalSyms int
+	pkgs, syms           atomic.Int64
+	stopCh               chan struct{}
+	wg                   sync.WaitGroup
+}
+
+func startProgress(totalPkgs, totalSyms int) *progress {
+	p := &progress{
+		w:         os.Stderr,
+		tty:       isTerminal(os.Stderr),
+		totalPkgs: totalPkgs,
+		totalSyms: totalSyms,
+		stopCh:    make(chan struct{}),
+	}
+	interval := progressInterval
+	if p.tty {
+		interval /= 5
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				p.print()
+			case <-p.stopCh:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *progress) done(syms int) {
+	p.pkgs.Add(1)
+	p.syms.Add(int64(syms))
+}
+
+func (p *progress) stop() {
+	close(p.stopCh)
+	p.wg.Wait()
+	p.print()
+	if p.tty {
+		fmt.Fprintln(p.w)
+	}
+}
+
+func (p *progress) print() {
+	line := fmt.Sprintf("loaded %d/%d packages, resolved %d/%d symbols", p.pkgs.Load(), p.totalPkgs, p.syms.Load(), p.totalSyms)
+	if p.tty {
+		fmt.Fprintf(p.w, "\r\033[K%s", line)
+		return
+	}
+	fmt.Fprintln(p.w, line)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"go/ast"
+	"go/types"
+	"log"
+	"unicode"
+	"unicode/utf8"
+)
+
+// constraintsOf returns, as canonical symbols, the named constraints of the
+// type parameters of the function, method or type key names. Constraints
+// written inline, such as `~int | Number`, contribute the named types they
+// mention; predeclared ones such as any and comparable are skipped.
+func (idx *packageIndex) constraintsOf(key functionKey) []string {
+	if idx.pkg.Types == nil {
+		return nil
+	}
+	scope := idx.pkg.Types.Scope()
+	var tparams *types.TypeParamList
+	if key.receiverType != "" {
+		if tn, ok := scope.Lookup(key.receiverType).(*types.TypeName); ok {
+			if named, ok := tn.Type().(*types.Named); ok {
+				tparams = named.TypeParams()
+			}
+		}
+	} else {
+		switch obj := scope.Lookup(key.funcName).(type) {
+		case *types.Func:
+			tparams = obj.Type().(*types.Signature).TypeParams()
+		case *types.TypeName:
+			if named, ok := obj.Type().(*types.Named); ok {
+				tparams = named.TypeParams()
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	var syms []string
+	var visit func(t types.Type)
+	visit = func(t types.Type) {
+		switch t := t.(type) {
+		case *types.Named:
+			obj := t.Obj()
+			if obj.Pkg() == nil {
+				return
+			}
+			if sym := obj.Pkg().Path() + "." + obj.Name(); !seen[sym] {
+				seen[sym] = true
+				syms = append(syms, sym)
+			}
+		case *types.Alias:
+			if t.Obj().Pkg() == nil {
+				return
+			}
+			visit(types.Unalias(t))
+		case *types.Interface:
+			for i := 0; i < t.NumEmbeddeds(); i++ {
+				visit(t.EmbeddedType(i))
+			}
+		case *types.Union:
+			for i := 0; i < t.Len(); i++ {
+				visit(t.Term(i).Type())
+			}
+		}
+	}
+	for i := 0; i < tparams.Len(); i++ {
+		visit(tparams.At(i).Constraint())
+	}
+	return syms
+}
+
+// embeddedInterfacesOf returns, as canonical symbols, the named interfaces
+// embedded in the interface type typeName, for -expand-interfaces.
+func (idx *packageIndex) embeddedInterfacesOf(typeName string) []string {
+	if idx.pkg.Types == nil {
+		return nil
+	}
+	tn, ok := idx.pkg.Types.Scope().Lookup(typeName).(*types.TypeName)
+	if !ok {
+		return nil
+	}
+	iface, ok := tn.Type().Underlying().(*types.Interface)
+	if !ok {
+		return nil
+	}
+	var syms []string
+	for i := 0; i < iface.NumEmbeddeds(); i++ {
+		named, ok := types.Unalias(iface.EmbeddedType(i)).(*types.Named)
+		if !ok || named.Obj().Pkg() == nil || !types.IsInterface(named) {
+			continue
+		}
+		syms = append(syms, named.Obj().Pkg().Path()+"."+named.Obj().Name())
+	}
+	return syms
+}
+
+// addRelated resolves the symbols collected for -with-constraints and
+// -expand-interfaces and adds their declarations to results, each under its
+// own package, repeating with whatever those declarations bring in until
+// nothing new turns up. A symbol already printed is not expanded again,
+// which also breaks cycles, and with -max-nodes expansion stops once that
+// many symbols have been added.
+func addRelated(absRoot string, results map[string]*printOutput, indexes *indexCache, opts *options) {
+	seen := make(map[string]bool)
+	for _, out := range results {
+		for _, def := range out.definitions {
+			for _, sym := range def.symbols {
+				seen[sym] = true
+			}
+		}
+	}
+	expanded := 0
+	pending := results
+	for {
+		byPkg := make(map[string][]string)
+		skipped := 0
+		for _, out := range pending {
+			for _, sym := range out.related {
+				if seen[sym] {
+					if opts.verbose {
+						log.Printf("%s is already printed; not expanding it again (cycle or shared reference)\n", sym)
+					}
+					continue
+				}
+				if opts.maxNodes > 0 && expanded >= opts.maxNodes {
+					skipped++
+					continue
+				}
+				seen[sym] = true
+				expanded++
+				byPkg[symbolPackage(sym)] = append(byPkg[symbolPackage(sym)], sym)
+			}
+		}
+		if skipped > 0 {
+			log.Printf("-max-nodes=%d reached: %d more related declarations not expanded\n", opts.maxNodes, skipped)
+		}
+		if len(byPkg) == 0 {
+			return
+		}
+		pending = resolvePackages(absRoot, byPkg, indexes, opts)
+		for pkgPath, out := range pending {
+			prev, ok := results[pkgPath]
+			if !ok {
+				out.unresolved = nil
+				results[pkgPath] = out
+				continue
+			}
+			for _, def := range out.definitions {
+				for _, sym := range def.symbols {
+					prev.addDefinition(sym, def)
+				}
+			}
+		}
+	}
+}
+
+// constructorsOf returns the functions NewT and newT of the package that
+// return T or *T, for -with-constructor. Without type information the
+// names alone decide.
+func (idx *packageIndex) constructorsOf(typeName string) []*ast.FuncDecl {
+	r, size := utf8.DecodeRuneInString(typeName)
+	title := string(unicode.ToUpper(r)) + typeName[size:]
+	var tn *types.TypeName
+	if idx.pkg.Types != nil {
+		tn, _ = idx.pkg.Types.Scope().Lookup(typeName).(*types.TypeName)
+	}
+	var fns []*ast.FuncDecl
+	for _, name := range []string{"New" + title, "new" + title} {
+		fn, ok := idx.funcDecls[functionKey{funcName: name}]
+		if !ok {
+			continue
+		}
+		if tn != nil && !returnsType(idx.pkg.Types.Scope().Lookup(name), tn) {
+			continue
+		}
+		fns = append(fns, fn)
+	}
+	return fns
+}
+
+func returnsType(obj types.Object, tn *types.TypeName) bool {
+	fn, ok := obj.(*types.Func)
+	if !ok {
+		return false
+	}
+	results := fn.Type().(*types.Signature).Results()
+	for i := 0; i < results.Len(); i++ {
+		t := results.At(i).Type()
+		if p, ok := t.(*types.Pointer); ok {
+			t = p.Elem()
+		}
+		if named, ok := types.Unalias(t).(*types.Named); ok && named.Obj() == tn {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"go/version"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// releaseTags returns the release tags go1.1 through the language version
+// lang, such as go1.21, as the toolchain of that version would set them.
+func releaseTags(lang string) ([]string, error) {
+	if !version.IsValid(lang) {
+		return nil, fmt.Errorf("invalid Go version %q: want e.g. go1.21", lang)
+	}
+	minor, err := strconv.Atoi(strings.TrimPrefix(version.Lang(lang), "go1."))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Go version %q: want e.g. go1.21", lang)
+	}
+	tags := make([]string, 0, minor)
+	for i := 1; i <= minor; i++ {
+		tags = append(tags, fmt.Sprintf("go1.%d", i))
+	}
+	return tags, nil
+}
+
+// loadSyntaxOnly loads pkgPath from its files parsed one by one, without
+// type information, like cached packages: for -lang, the package's files,
+// including those excluded for the current toolchain, are matched against
+// the build constraints with lang's release tags; for a single-byte
+// -encoding, each file is parsed with its non-ASCII bytes masked, which the
+// Go parser would otherwise reject, so offsets still index the file.
+func loadSyntaxOnly(absRoot, pkgPath string, opts *options) (*packages.Package, error) {
+	ctxt := build.Default
+	if opts.lang != "" {
+		tags, err := releaseTags(opts.lang)
+		if err != nil {
+			return nil, err
+		}
+		ctxt.ReleaseTags = tags
+	}
+	cfg := &packages.Config{
+		Dir:  absRoot,
+		Env:  loadEnv(absRoot),
+		Mode: packages.NeedName | packages.NeedFiles,
+	}
+	pkgs, err := packages.Load(cfg, pkgPath)
+	if err != nil {
+		return nil, fmt.Errorf("packages.Load error: %w", err)
+	}
+	if len(pkgs) == 0 {
+		return nil, errors.New("no packages found")
+	}
+	p := pkgs[0]
+
+	files := append(append([]string(nil), p.GoFiles...), p.IgnoredFiles...)
+	sort.Strings(files)
+
+	fset := token.NewFileSet()
+	pkg := &packages.Package{
+		ID:      p.ID,
+		Name:    p.Name,
+		PkgPath: p.PkgPath,
+		Fset:    fset,
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f, ".go") {
+			continue
+		}
+		if ok, err := ctxt.MatchFile(filepath.Dir(f), filepath.Base(f)); err != nil || !ok {
+			continue
+		}
+		src, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if singleByteEncoding(opts.encoding) {
+			src = maskNonASCII(src)
+		}
+		fAST, err := parser.ParseFile(fset, f, src, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		if pkg.Name == "" {
+			pkg.Name = fAST.Name.Name
+		}
+		pkg.Syntax = append(pkg.Syntax, fAST)
+		pkg.CompiledGoFiles = append(pkg.CompiledGoFiles, f)
+	}
+	if len(pkg.Syntax) == 0 {
+		return nil, fmt.Errorf("no Go files in %s match the build constraints", pkgPath)
+	}
+	return pkg, nil
+}
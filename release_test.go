@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReleaseTags(t *testing.T) {
+	tests := []struct {
+		lang    string
+		last    string
+		n       int
+		wantErr bool
+	}{
+		{"go1.1", "go1.1", 1, false},
+		{"go1.21", "go1.21", 21, false},
+		{"go1.21.3", "go1.21", 21, false},
+		{"1.21", "", 0, true},
+		{"go2", "", 0, true},
+	}
+	for _, tt := range tests {
+		tags, err := releaseTags(tt.lang)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("releaseTags(%q) error = %v, want error %v", tt.lang, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if len(tags) != tt.n || tags[0] != "go1.1" || tags[len(tags)-1] != tt.last {
+			t.Errorf("releaseTags(%q) = %v, want go1.1 through %s", tt.lang, tags, tt.last)
+		}
+	}
+}
+
+func TestLangSelectsFiles(t *testing.T) {
+	root := fixtureRoot(t)
+	const sym = "example.com/fx/ver.Version"
+	tests := []struct{ lang, file, want string }{
+		{"go1.20", "old.go", "before go1.21"},
+		{"go1.21", "new.go", "go1.21 and later"},
+		{"go1.22", "new.go", "go1.21 and later"},
+	}
+	for _, tt := range tests {
+		opts := testOptions()
+		opts.lang = tt.lang
+		def := definitionOf(t, resolve(t, root, opts, sym), sym)
+		if def == nil {
+			continue
+		}
+		if filepath.Base(def.file) != tt.file || !strings.Contains(def.source, tt.want) {
+			t.Errorf("-lang %s: got %s from %s, want %q from %s", tt.lang, def.source, filepath.Base(def.file), tt.want, tt.file)
+		}
+	}
+}
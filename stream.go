@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// streamConflicts lists the options set in opts that work on the whole
+// run, which -stream would redo, and overwrite, once per batch.
+func streamConflicts(opts *options) []string {
+	var names []string
+	for _, c := range []struct {
+		name string
+		set  bool
+	}{
+		{"-watch", opts.watch},
+		{"-compare", opts.compare != ""},
+		{"-dry-run", opts.dryRun},
+		{"-echo-symbols", opts.echoSymbols},
+		{"-between", opts.between},
+		{"-flat-json", opts.flatJSON},
+		{"-format=csv", opts.format == "csv"},
+		{"-format=markdown-table", opts.format == "markdown-table"},
+		{"-toc", opts.toc},
+		{"-output-dir", opts.outputDir != ""},
+		{"-unresolved-out", opts.unresolvedOut != ""},
+		{"-stats-json", opts.statsJSON != ""},
+		{"-index-out", opts.indexOut != ""},
+		{"-limit-symbols", opts.limitSymbols > 0},
+		{"-max-packages", opts.maxPackages > 0},
+		{"-fail-empty", opts.failEmpty},
+	} {
+		if c.set {
+			names = append(names, c.name)
+		}
+	}
+	return names
+}
+
+// streamExtract reads symbols from r as they arrive and extracts them in
+// batches instead of after the whole input: a package is flushed once
+// -stream-batch of its symbols are buffered, and everything buffered is
+// flushed when no input arrives for -stream-idle and at the end of the
+// input. Each flush is a run of extract of its own; symbols seen before are
+// dropped unless -no-dedup is set. It returns the highest exit code of those runs.
+func streamExtract(r io.Reader, parser SymbolParser, absRoot string, opts *options) (int, error) {
+	r, err := maybeGunzip(r)
+	if err != nil {
+		return 0, err
+	}
+	lines := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		errc <- scanner.Err()
+		close(lines)
+	}()
+
+	ep, _ := parser.(edgeParser)
+	seen := make(map[string]bool)
+	pending := make(map[string][]string)
+	code := 0
+	flush := func(pkgPaths ...string) {
+		var batch []string
+		for _, pkgPath := range pkgPaths {
+			batch = append(batch, pending[pkgPath]...)
+			delete(pending, pkgPath)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if _, c := extract(batch, absRoot, opts); c > code {
+			code = c
+		}
+	}
+	flushAll := func() {
+		pkgPaths := make([]string, 0, len(pending))
+		for pkgPath := range pending {
+			pkgPaths = append(pkgPaths, pkgPath)
+		}
+		sort.Strings(pkgPaths)
+		flush(pkgPaths...)
+	}
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				flushAll()
+				return code, <-errc
+			}
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			syms, err := parser.ParseLine(line)
+			if err != nil {
+				log.Printf("skip line %q: %v\n", line, err)
+				continue
+			}
+			if opts.callGraph != nil && ep != nil {
+				if caller, callee, ok := ep.ParseEdge(line); ok {
+					opts.callGraph.add(caller, callee)
+				}
+			}
+			for _, sym := range syms {
+				if seen[sym] && !opts.noDedup {
+					continue
+				}
+				seen[sym] = true
+				pkgPath := symbolPackage(sym)
+				pending[pkgPath] = append(pending[pkgPath], sym)
+				if len(pending[pkgPath]) >= opts.streamBatch {
+					flush(pkgPath)
+				}
+			}
+		case <-time.After(opts.streamIdle):
+			flushAll()
+		}
+	}
+}
@@ -0,0 +1,15 @@
+// Package bar is a major-version module that example.com/fx replaces with
+// this directory.
+package bar
+
+type Client struct {
+	addr string
+}
+
+func New(addr string) *Client {
+	return &Client{addr: addr}
+}
+
+func (c *Client) Do() error {
+	return nil
+}
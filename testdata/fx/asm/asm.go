@@ -0,0 +1,5 @@
+// Package asm declares a function implemented in assembly.
+package asm
+
+// Add returns a+b.
+func Add(a, b int) int
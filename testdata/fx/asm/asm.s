@@ -0,0 +1 @@
+// The fixture is only parsed and type-checked, so Add needs no body here.
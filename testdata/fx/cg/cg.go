@@ -0,0 +1,13 @@
+// Package cg uses cgo.
+package cg
+
+// static int twice(int x) { return 2 * x; }
+import "C"
+
+func Twice(x int) int {
+	return int(C.twice(C.int(x)))
+}
+
+type Box struct {
+	N C.int
+}
@@ -0,0 +1,13 @@
+package main
+
+import "os"
+
+func main() {
+	if err := run(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	return nil
+}
@@ -0,0 +1,6 @@
+package decl
+
+var (
+	Lo, Hi = 1, 2 // bounds
+	Step   = 3
+)
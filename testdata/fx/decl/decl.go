@@ -0,0 +1,56 @@
+// Package decl holds plain declarations for the extraction tests.
+package decl
+
+import (
+	"fmt"
+
+	bar "example.com/bar/v2"
+)
+
+const (
+	MaxSize = 100 // bytes
+	MinSize = 1
+	// Limit has a doc comment that MinSize must not take.
+	Limit = 10
+)
+
+type Server struct {
+	Addr string // listen address
+	Port int
+}
+
+type Handler interface {
+	Serve(s *Server) error
+	Close() error
+}
+
+func (s *Server) Serve(h Handler) error {
+	fmt.Println(s.Addr)
+	return nil
+}
+
+func (*Server) Close() error { return nil }
+
+func (s Server) String() string { return s.Addr }
+
+func Keys[K comparable, V any](m map[K]V) []K {
+	var keys []K
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func MapSlice[T, U any](xs []T, f func(T) U) []U {
+	out := make([]U, 0, len(xs))
+	for _, x := range xs {
+		out = append(out, f(x))
+	}
+	return out
+}
+
+var Default = &Server{Addr: "localhost"}
+
+func Dial() *bar.Client {
+	return bar.New(Default.Addr)
+}
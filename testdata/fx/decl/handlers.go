@@ -0,0 +1,5 @@
+package decl
+
+var OnServe = func(s *Server, h Handler) error {
+	return h.Serve(s)
+}
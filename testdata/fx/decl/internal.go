@@ -0,0 +1,13 @@
+package decl
+
+type internalState struct {
+	n int
+}
+
+func (s *internalState) reset() {
+	s.n = 0
+}
+
+func helperFunc() int {
+	return 1
+}
@@ -0,0 +1,6 @@
+// Package dup declares Dup twice and only loads with -load-errors-ok.
+package dup
+
+func Dup() int {
+	return 1
+}
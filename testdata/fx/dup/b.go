@@ -0,0 +1,5 @@
+package dup
+
+func Dup() int {
+	return 2
+}
@@ -0,0 +1,32 @@
+// Package gen holds generic declarations.
+package gen
+
+type Dict[K comparable, V any] struct {
+	m map[K]V
+}
+
+func (d *Dict[K, V]) Get(k K) V {
+	return d.m[k]
+}
+
+type Tri[A, B, C any] struct {
+	a A
+	b B
+	c C
+}
+
+func (t Tri[A, B, C]) First() A {
+	return t.a
+}
+
+func Apply[T any](x T) T {
+	return x
+}
+
+type Box[T any] struct {
+	v T
+}
+
+func (b *Box[T]) Value() T {
+	return b.v
+}
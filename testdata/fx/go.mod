@@ -0,0 +1,7 @@
+module example.com/fx
+
+go 1.21
+
+require example.com/bar/v2 v2.0.0
+
+replace example.com/bar/v2 => ../bar
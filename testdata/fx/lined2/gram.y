@@ -0,0 +1,11 @@
+%{
+package lined2
+%}
+%token NUM
+%%
+top: NUM
+%%
+// action A
+// action A
+// action B
+// action B
@@ -0,0 +1,16 @@
+package rnd
+
+import (
+	"math/rand"
+	"strings"
+)
+
+// Roll returns a number from 1 to 6.
+func Roll() int {
+	return rand.Intn(6) + 1
+}
+
+// Upper is here for its import of strings.
+func Upper(s string) string {
+	return strings.ToUpper(s)
+}
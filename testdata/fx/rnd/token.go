@@ -0,0 +1,17 @@
+package rnd
+
+import "crypto/rand"
+
+// Token returns n random bytes.
+func Token(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+type lengths struct{ n int }
+
+// Len reads a field of a parameter named like a package another file imports.
+func Len(strings lengths) int {
+	return strings.n
+}
@@ -0,0 +1,5 @@
+//go:build !go1.21
+
+package ver
+
+func Version() string { return "before go1.21" }
@@ -0,0 +1,8 @@
+// Package app is a GOPATH-mode project with no go.mod.
+package app
+
+import "legacy.org/app/util"
+
+func Hello() string {
+	return util.Greeting + ", world"
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// loadTestVariant loads pkgPath together with its tests and picks one of
+// the package variants go/packages returns for the test build. Both test
+// variants have ForTest set to the package under test; the external one is
+// told apart by its PkgPath ending in _test. Symbols of pkg_test are only
+// found with -test-variant=external or both, and other packages resolve in
+// the internal test variant unless -test-variant=external asks for the
+// plain package.
+func loadTestVariant(absRoot, pkgPath string, opts *options) (*packages.Package, error) {
+	base := strings.TrimSuffix(pkgPath, "_test")
+	external := base != pkgPath
+	if external && opts.testVariant == "internal" {
+		return nil, fmt.Errorf("%s is an external test package: use -test-variant=external or both", pkgPath)
+	}
+
+	cfg := &packages.Config{
+		Dir:   absRoot,
+		Env:   loadEnv(absRoot),
+		Mode:  packages.NeedName | packages.NeedForTest | packages.NeedTypes | packages.NeedTypesInfo | packages.NeedSyntax | packages.NeedCompiledGoFiles,
+		Tests: true,
+	}
+	pkgs, err := packages.Load(cfg, base)
+	if err != nil {
+		return nil, fmt.Errorf("packages.Load error: %w", err)
+	}
+
+	forTest := base
+	if !external && opts.testVariant == "external" {
+		forTest = ""
+	}
+	var plain *packages.Package
+	for _, p := range pkgs {
+		if p.PkgPath != pkgPath {
+			continue
+		}
+		if p.ForTest == forTest {
+			if err := checkPackageErrors(p, opts.loadErrorsOK); err != nil {
+				return nil, err
+			}
+			return p, nil
+		}
+		if p.ForTest == "" {
+			plain = p
+		}
+	}
+	// A package without in-package test files has no internal test variant.
+	if plain != nil && !external {
+		if err := checkPackageErrors(plain, opts.loadErrorsOK); err != nil {
+			return nil, err
+		}
+		return plain, nil
+	}
+	return nil, fmt.Errorf("no test variant of %s found", pkgPath)
+}
+
+type exampleFunc struct {
+	name   string
+	source string
+}
+
+// examples returns the Example functions of the _test.go files in the
+// package's directory, internal and external tests alike, parsed on first
+// use.
+func (idx *packageIndex) examples() []exampleFunc {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.exampleFuncs != nil {
+		return idx.exampleFuncs
+	}
+	idx.exampleFuncs = []exampleFunc{}
+	var dir string
+	for filename := range idx.files {
+		if strings.HasSuffix(filename, ".go") {
+			dir = filepath.Dir(filename)
+			break
+		}
+	}
+	if dir == "" {
+		return idx.exampleFuncs
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*_test.go"))
+	for _, f := range files {
+		src, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		fset := token.NewFileSet()
+		fAST, err := parser.ParseFile(fset, f, src, parser.ParseComments)
+		if err != nil {
+			log.Printf("skip examples of %s: %v\n", f, err)
+			continue
+		}
+		for _, d := range fAST.Decls {
+			fn, ok := d.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil || !strings.HasPrefix(fn.Name.Name, "Example") {
+				continue
+			}
+			idx.exampleFuncs = append(idx.exampleFuncs, exampleFunc{
+				name:   fn.Name.Name,
+				source: string(src[fset.Position(fn.Pos()).Offset:fset.Position(fn.End()).Offset]),
+			})
+		}
+	}
+	return idx.exampleFuncs
+}
+
+// exampleSource returns the Example functions documenting key, following
+// the naming convention of go test: ExampleF and ExampleT for a function
+// or type, ExampleT_M for a method, each optionally followed by _suffix
+// starting with a lower-case letter. Each is preceded by `// Example:`.
+func (idx *packageIndex) exampleSource(key functionKey) string {
+	base := "Example" + key.funcName
+	if key.receiverType != "" {
+		base = "Example" + key.receiverType + "_" + key.funcName
+	}
+	var sb strings.Builder
+	for _, ex := range idx.examples() {
+		if ex.name != base {
+			suffix, ok := strings.CutPrefix(ex.name, base+"_")
+			if !ok || suffix == "" {
+				continue
+			}
+			if r, _ := utf8.DecodeRuneInString(suffix); !unicode.IsLower(r) {
+				continue
+			}
+		}
+		fmt.Fprintf(&sb, "\n\n// Example: %s\n%s", ex.name, ex.source)
+	}
+	return sb.String()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const watchDebounce = 200 * time.Millisecond
+
+func watch(symbols []string, absRoot string, opts *options) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	tty := isTerminal(os.Stdout)
+	watched := make(map[string]bool)
+	for {
+		if tty {
+			fmt.Print("\033[H\033[2J")
+		}
+		results, _ := extract(symbols, absRoot, opts)
+		for _, dir := range contributingDirs(results) {
+			if watched[dir] {
+				continue
+			}
+			if err := w.Add(dir); err != nil {
+				log.Printf("cannot watch %s: %v\n", dir, err)
+				continue
+			}
+			watched[dir] = true
+		}
+		if len(watched) == 0 {
+			return fmt.Errorf("no source files to watch")
+		}
+		if err := waitForChange(w); err != nil {
+			return err
+		}
+	}
+}
+
+func contributingDirs(results map[string]*printOutput) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, out := range results {
+		for _, def := range out.definitions {
+			dir := filepath.Dir(def.file)
+			if !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	return dirs
+}
+
+// waitForChange blocks until a .go file in a watched directory changes and
+// no further events arrive for watchDebounce.
+func waitForChange(w *fsnotify.Watcher) error {
+	var timer <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return fmt.Errorf("watcher closed")
+			}
+			if strings.HasSuffix(ev.Name, ".go") && ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+				timer = time.After(watchDebounce)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return fmt.Errorf("watcher closed")
+			}
+			log.Printf("watch error: %v\n", err)
+		case <-timer:
+			return nil
+		}
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
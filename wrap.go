@@ -0,0 +1,95 @@
+package main
+
+import (
+	"go/scanner"
+	"go/token"
+	"strings"
+)
+
+const tabWidth = 4
+
+// wrapComments re-wraps runs of whole-line // comments in src to at most
+// width columns. Code, trailing comments, /* */ blocks, directives and
+// indented (preformatted) comment lines are left untouched.
+func wrapComments(src string, width int) string {
+	lines := strings.Split(src, "\n")
+	commentOnly := commentOnlyLines(src, len(lines))
+
+	var out []string
+	for i := 0; i < len(lines); {
+		if !commentOnly[i] || !isProse(lines[i]) {
+			out = append(out, lines[i])
+			i++
+			continue
+		}
+		indent := lines[i][:strings.Index(lines[i], "//")]
+		var words []string
+		j := i
+		for ; j < len(lines) && commentOnly[j] && isProse(lines[j]); j++ {
+			if lines[j][:strings.Index(lines[j], "//")] != indent {
+				break
+			}
+			words = append(words, strings.Fields(strings.TrimPrefix(strings.TrimSpace(lines[j]), "//"))...)
+		}
+		out = append(out, fillComment(indent, words, width)...)
+		i = j
+	}
+	return strings.Join(out, "\n")
+}
+
+func commentOnlyLines(src string, n int) []bool {
+	commentOnly := make([]bool, n)
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	var s scanner.Scanner
+	s.Init(file, []byte(src), func(token.Position, string) {}, scanner.ScanComments)
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok != token.COMMENT || !strings.HasPrefix(lit, "//") {
+			continue
+		}
+		p := fset.Position(pos)
+		lineStart := p.Offset - (p.Column - 1)
+		if strings.TrimSpace(src[lineStart:p.Offset]) == "" && p.Line-1 < n {
+			commentOnly[p.Line-1] = true
+		}
+	}
+	return commentOnly
+}
+
+// isProse reports whether a comment line is ordinary text that may be
+// joined with its neighbours.
+func isProse(line string) bool {
+	text := strings.TrimPrefix(strings.TrimSpace(line), "//")
+	if strings.TrimSpace(text) == "" {
+		return false
+	}
+	// Directives (//go:generate) and preformatted lines (//	code).
+	return strings.HasPrefix(text, " ") && !strings.HasPrefix(text, "  ") && !strings.HasPrefix(text, " \t")
+}
+
+func fillComment(indent string, words []string, width int) []string {
+	prefix := indent + "//"
+	prefixWidth := len(strings.ReplaceAll(prefix, "\t", strings.Repeat(" ", tabWidth)))
+
+	var lines []string
+	var b strings.Builder
+	col := prefixWidth
+	for _, w := range words {
+		if b.Len() > 0 && col+1+len(w) > width {
+			lines = append(lines, prefix+b.String())
+			b.Reset()
+			col = prefixWidth
+		}
+		b.WriteString(" ")
+		b.WriteString(w)
+		col += 1 + len(w)
+	}
+	if b.Len() > 0 {
+		lines = append(lines, prefix+b.String())
+	}
+	return lines
+}